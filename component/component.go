@@ -26,4 +26,7 @@ const (
 	COMPONENT_TYPE_TCP_CLIENT
 	COMPONENT_TYPE_DB_MONGODB
 	COMPONENT_TYPE_DB_MYSQL
+	COMPONENT_TYPE_WS_SERVER
+	COMPONENT_TYPE_UDP_SERVER
+	COMPONENT_TYPE_UDP_CLIENT
 )
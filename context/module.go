@@ -1,15 +1,21 @@
 package context
 
 import (
+	gocontext "context"
 	"github.com/Cyinx/einx/timer"
+	"time"
 )
 
 type TimerHandler = timer.TimerHandler
+type AsyncRpcCallback func([]interface{}, error)
 type Module interface {
 	GetID() AgentID
 	GetName() string
 	RpcCall(string, ...interface{})
 	AwaitRpcCall(string, ...interface{}) []interface{}
+	AwaitRpcCallTimeout(time.Duration, string, ...interface{}) ([]interface{}, error)
+	AwaitRpcCallContext(gocontext.Context, string, ...interface{}) ([]interface{}, error)
+	AsyncRpcCall(Module, string, []interface{}, AsyncRpcCallback)
 	AddTimer(delay uint64, op TimerHandler, args ...interface{}) uint64
 	RemoveTimer(timer_id uint64) bool
 }
@@ -16,6 +16,7 @@ type Agent = agent.Agent
 type AgentID = agent.AgentID
 type Module = context.Module
 type Context = context.Context
+type AsyncRpcCallback = context.AsyncRpcCallback
 type EventMsg = event.EventMsg
 type EventType = event.EventType
 type ArgsVar = module.ArgsVar
@@ -26,17 +27,31 @@ type Component = component.Component
 type ComponentID = component.ComponentID
 type ModuleRouter = module.ModuleRouter
 type ComponentMgr = module.ComponentMgr
+type NodeMgr = module.NodeMgr
 type SessionEventMsg = event.SessionEventMsg
 type LuaRuntime = lua_state.LuaRuntime
 type NetLinker = network.NetLinker
 type ProtoTypeID = network.ProtoTypeID
 type SessionMgr = network.SessionMgr
+type ThrottleSessionMgr = network.ThrottleSessionMgr
 type SessionHandler = network.SessionHandler
 type ITcpClientMgr = network.ITcpClientMgr
 type ITcpServerMgr = network.ITcpServerMgr
 type TimerHandler = timer.TimerHandler
 type EventReceiver = event.EventReceiver
 type ITranMsgMultiple = network.ITranMsgMultiple
+type RpcCallback = network.RpcCallback
+type RpcRequestHandler = network.RpcRequestHandler
+type MsgCodec = network.MsgCodec
+type CodecRegistry = network.CodecRegistry
+type TypedSessionHandler = network.TypedSessionHandler
+type BufferSessionHandler = network.BufferSessionHandler
+type MsgBuffer = network.MsgBuffer
+type CloseReason = network.CloseReason
+type Group = network.Group
+type PacketCodec = network.PacketCodec
+type PacketFrame = network.PacketFrame
+type EinxPacketCodec = network.EinxPacketCodec
 
 type einx struct {
 	endWait   sync.WaitGroup
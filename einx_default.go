@@ -46,6 +46,30 @@ func GetModule(name string) Module {
 	return module.GetModule(name)
 }
 
+func GetRemoteModule(addr string) Module {
+	return module.GetRemoteModule(addr)
+}
+
+func NewNodeMgr() *NodeMgr {
+	return module.NewNodeMgr()
+}
+
+func GetGroup(name string) *Group {
+	return network.GetGroup(name)
+}
+
+func RemoveGroup(name string) {
+	network.RemoveGroup(name)
+}
+
+func Multicast(linkers []NetLinker, msgID ProtoTypeID, b []byte) int {
+	return network.Multicast(linkers, msgID, b)
+}
+
+func NewCodecRegistry() *CodecRegistry {
+	return network.NewCodecRegistry()
+}
+
 func NewLuaStae() *lua_state.LuaRuntime {
 	return lua_state.NewLuaStae()
 }
@@ -66,6 +90,54 @@ func AddTcpServerMgr(m module.Module, addr string, mgr interface{}, opts ...Opti
 	er.PushEventMsg(e)
 }
 
+func AddWsServerMgr(m module.Module, addr string, mgr interface{}, opts ...Option) {
+	er := m.(event.EventReceiver)
+
+	opts = append(opts, NetworkOption.ListenAddr(addr))
+	opts = append(opts, network.Module(er))
+	opts = append(opts, NetworkOption.ServeHandler(mgr.(SessionHandler)))
+
+	wsServer := network.NewWsServerMgr(opts...)
+
+	e := &event.ComponentEventMsg{}
+	e.MsgType = event.EVENT_COMPONENT_CREATE
+	e.Sender = wsServer
+	e.Attach = mgr
+	er.PushEventMsg(e)
+}
+
+func AddUdpServerMgr(m module.Module, addr string, mgr interface{}, opts ...Option) {
+	er := m.(event.EventReceiver)
+
+	opts = append(opts, NetworkOption.ListenAddr(addr))
+	opts = append(opts, network.Module(er))
+	opts = append(opts, NetworkOption.ServeHandler(mgr.(SessionHandler)))
+
+	udpServer := network.NewUdpServerMgr(opts...)
+
+	e := &event.ComponentEventMsg{}
+	e.MsgType = event.EVENT_COMPONENT_CREATE
+	e.Sender = udpServer
+	e.Attach = mgr
+	er.PushEventMsg(e)
+}
+
+func StartUdpClientMgr(m module.Module, name string, mgr interface{}, opts ...Option) {
+	er := m.(event.EventReceiver)
+
+	opts = append(opts, NetworkOption.Name(name))
+	opts = append(opts, network.Module(er))
+	opts = append(opts, NetworkOption.ServeHandler(mgr.(SessionHandler)))
+
+	udpClient := network.NewUdpClientMgr(opts...)
+
+	e := &event.ComponentEventMsg{}
+	e.MsgType = event.EVENT_COMPONENT_CREATE
+	e.Sender = udpClient
+	e.Attach = mgr
+	er.PushEventMsg(e)
+}
+
 func StartTcpClientMgr(m module.Module, name string, mgr interface{}, opts ...Option) {
 	er := m.(event.EventReceiver)
 
@@ -25,6 +25,7 @@ const (
 	EVENT_COMPONENT_CREATE
 	EVENT_COMPONENT_ERROR
 	EVENT_COMPONENT_CUSTOM
+	EVENT_TCP_THROTTLED
 )
 
 type EventMsg interface {
@@ -137,7 +138,7 @@ type AwaitRpcEventMsg struct {
 	Sender  Agent
 	RpcName string
 	Data    []interface{}
-	Await   chan []interface{}
+	Reply   func([]interface{}, error)
 }
 
 func (m *AwaitRpcEventMsg) GetType() EventType {
@@ -153,5 +154,5 @@ func (m *AwaitRpcEventMsg) Reset() {
 	m.Sender = nil
 	m.RpcName = ""
 	m.Data = nil
-	m.Await = nil
+	m.Reply = nil
 }
\ No newline at end of file
@@ -1,6 +1,6 @@
 module github.com/Cyinx/einx
 
-go 1.12
+go 1.20
 
 require (
 	github.com/go-sql-driver/mysql v1.4.1
@@ -1,9 +1,12 @@
 package module
 
 import (
+	gocontext "context"
+	"errors"
 	"runtime"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Cyinx/einx/agent"
@@ -31,8 +34,10 @@ type EventQueue = event.EventQueue
 type TimerHandler = timer.TimerHandler
 type TimerManager = timer.TimerManager
 type SessionMgr = network.SessionMgr
+type ThrottleSessionMgr = network.ThrottleSessionMgr
 type Module = context.Module
 type Context = context.Context
+type AsyncRpcCallback = context.AsyncRpcCallback
 type ProtoTypeID = uint32
 type MsgHandler func(Context, interface{})
 type RpcHandler func(Context, *ArgsVar)
@@ -54,6 +59,15 @@ var (
 	MODULE_EVENT_LENGTH   = 128
 )
 
+var (
+	MODULE_CLOSED_ERR        = errors.New("module closed.")
+	MODULE_RPC_NOT_FOUND_ERR = errors.New("module rpc handler not found.")
+	MODULE_RPC_PANIC_ERR     = errors.New("module rpc handler panic.")
+)
+
+// MODULE_ASYNC_RPC_TIMEOUT bounds AsyncRpcCall to a local module, in milliseconds.
+const MODULE_ASYNC_RPC_TIMEOUT = 30 * 1000
+
 type module struct {
 	id            AgentID
 	evQueue       *EventQueue
@@ -76,6 +90,9 @@ type module struct {
 	eventCount    uint32
 	eventIndex    uint32
 	beginTime     int64
+	closeFlag     int32
+	awaitLock     sync.Mutex
+	awaitMap      map[*awaitReply]bool
 }
 
 func (m *module) GetID() AgentID {
@@ -130,14 +147,131 @@ func (m *module) RpcCall(name string, args ...interface{}) {
 }
 
 func (m *module) AwaitRpcCall(name string, args ...interface{}) []interface{} {
-	rpc_msg := m.awaitMsgPool.Get().(*AwaitRpcEventMsg)
-	rpc_msg.MsgType = event.EVENT_MODULE_AWAITRPC
-	rpc_msg.Sender = m
-	rpc_msg.Data = args
-	rpc_msg.RpcName = name
-	rpc_msg.Await = make(chan []interface{})
-	m.evQueue.Push(rpc_msg)
-	return <-rpc_msg.Await
+	results, err := m.AwaitRpcCallContext(gocontext.Background(), name, args...)
+	if err != nil {
+		slog.LogWarning("module", "module [%s] await rpc [%s] error: %v", m.name, name, err)
+	}
+	return results
+}
+
+func (m *module) AwaitRpcCallTimeout(timeout time.Duration, name string, args ...interface{}) ([]interface{}, error) {
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), timeout)
+	defer cancel()
+	return m.AwaitRpcCallContext(ctx, name, args...)
+}
+
+type awaitResult struct {
+	results []interface{}
+	err     error
+}
+
+func (m *module) AwaitRpcCallContext(ctx gocontext.Context, name string, args ...interface{}) ([]interface{}, error) {
+	if m.isClosed() == true {
+		return nil, MODULE_CLOSED_ERR
+	}
+
+	caller, err := awaitGraph.begin(m)
+	if err != nil {
+		return nil, err
+	}
+	defer awaitGraph.end(caller)
+
+	await := make(chan awaitResult, 1)
+	reply := m.routerAwaitRpc(m, name, args, func(results []interface{}, err error) {
+		await <- awaitResult{results: results, err: err}
+	})
+	if m.isClosed() == true {
+		reply(nil, MODULE_CLOSED_ERR)
+	}
+
+	select {
+	case r := <-await:
+		return r.results, r.err
+	case <-ctx.Done():
+		reply(nil, ctx.Err())
+		r := <-await
+		return r.results, r.err
+	}
+}
+
+// AsyncRpcCall runs rpc name on target without blocking m. The result passed to
+// ctx.Done by the target handler is posted back, and cb runs on m's event loop.
+// A local target that does not answer within MODULE_ASYNC_RPC_TIMEOUT fails with
+// RPC_CALL_TIMEOUT_ERR, a late answer is then dropped.
+func (m *module) AsyncRpcCall(target Module, name string, args []interface{}, cb AsyncRpcCallback) {
+	var replied int32 = 0
+	var timerID uint64 = 0
+	reply := func(results []interface{}, err error) {
+		if atomic.CompareAndSwapInt32(&replied, 0, 1) == false {
+			return
+		}
+		if cb == nil || m.isClosed() == true {
+			return
+		}
+		sender, _ := target.(Agent)
+		m.evQueue.Push(&asyncReplyEventMsg{sender: sender, cb: cb, results: results, err: err, cancel: func() {
+			if timerID != 0 {
+				m.RemoveTimer(timerID)
+			}
+		}})
+	}
+
+	switch t := target.(type) {
+	case *module:
+		if t.isClosed() == true {
+			reply(nil, MODULE_CLOSED_ERR)
+			return
+		}
+		var done func([]interface{}, error)
+		timerID = m.AddTimer(MODULE_ASYNC_RPC_TIMEOUT, func([]interface{}) {
+			timerID = 0
+			done(nil, network.RPC_CALL_TIMEOUT_ERR)
+		})
+		done = t.routerAwaitRpc(m, name, args, reply)
+		if t.isClosed() == true {
+			done(nil, MODULE_CLOSED_ERR)
+		}
+	case *remoteModule:
+		t.asyncRpcCall(name, args, reply)
+	default:
+		slog.LogError("module", "module [%s] async rpc [%s] unknown target module type %T", m.name, name, target)
+		reply(nil, MODULE_RPC_NOT_FOUND_ERR)
+	}
+}
+
+type asyncReplyEventMsg struct {
+	sender  Agent
+	cb      AsyncRpcCallback
+	results []interface{}
+	err     error
+	cancel  func()
+}
+
+func (e *asyncReplyEventMsg) GetType() EventType {
+	return event.EVENT_COMPONENT_CUSTOM
+}
+
+func (e *asyncReplyEventMsg) GetSender() Agent {
+	return e.sender
+}
+
+func (e *asyncReplyEventMsg) GetAction() func(CustomActionEventMsg) {
+	return doAsyncReply
+}
+
+func (e *asyncReplyEventMsg) Reset() {
+	e.sender = nil
+	e.cb = nil
+	e.results = nil
+	e.err = nil
+	e.cancel = nil
+}
+
+func doAsyncReply(msg CustomActionEventMsg) {
+	e := msg.(*asyncReplyEventMsg)
+	e.cancel()
+	e.cb(e.results, e.err)
+	e.Reset()
 }
 
 func (m *module) RouterMsg(agent Agent, msgID ProtoTypeID, msg interface{}) {
@@ -153,6 +287,24 @@ func (m *module) RouterRpc(agent Agent, name string, args []interface{}) {
 	m.evQueue.Push(rpc_msg)
 }
 
+// routerAwaitRpc queues an await rpc and returns its guarded reply, which a caller
+// giving up calls to fail the rpc and drop it from the awaitMap of m.
+func (m *module) routerAwaitRpc(agent Agent, name string, args []interface{}, reply func([]interface{}, error)) func([]interface{}, error) {
+	r := &awaitReply{m: m, reply: reply}
+	m.awaitLock.Lock()
+	m.awaitMap[r] = true
+	m.awaitLock.Unlock()
+
+	rpc_msg := m.awaitMsgPool.Get().(*AwaitRpcEventMsg)
+	rpc_msg.MsgType = event.EVENT_MODULE_AWAITRPC
+	rpc_msg.Sender = agent
+	rpc_msg.Data = args
+	rpc_msg.RpcName = name
+	rpc_msg.Reply = r.done
+	m.evQueue.Push(rpc_msg)
+	return r.done
+}
+
 func (m *module) RegisterHandler(typeID ProtoTypeID, handler MsgHandler) {
 	_, ok := m.msgHandlerMap[typeID]
 	if ok == true {
@@ -184,6 +336,9 @@ func (m *module) Run(wait *sync.WaitGroup) {
 	defer m.recover(wait)
 	wait.Add(1)
 	defer wait.Done()
+	gid := goroutineID()
+	awaitGraph.addRunner(gid, m)
+	defer awaitGraph.removeRunner(gid)
 	m.beginTime = time.Now().UnixNano() / 1e9
 	timerManager := m.timerManager
 	var (
@@ -237,12 +392,57 @@ runClose:
 	m.doClose(wait)
 }
 
+func (m *module) isClosed() bool {
+	return atomic.LoadInt32(&m.closeFlag) == 1
+}
+
+func (m *module) removeAwait(r *awaitReply) {
+	m.awaitLock.Lock()
+	delete(m.awaitMap, r)
+	m.awaitLock.Unlock()
+}
+
+func (m *module) failAwaits() {
+	eventList := m.eventList
+	for {
+		for m.eventIndex < m.eventCount {
+			if rpcMsg, ok := eventList[m.eventIndex].(*AwaitRpcEventMsg); ok == true {
+				rpcMsg.Reply(nil, MODULE_CLOSED_ERR)
+			}
+			eventList[m.eventIndex] = nil
+			m.eventIndex++
+		}
+		m.eventCount = m.evQueue.Get(eventList, uint32(MODULE_EVENT_LENGTH))
+		m.eventIndex = 0
+		if m.eventCount == 0 {
+			break
+		}
+	}
+
+	m.awaitLock.Lock()
+	awaits := make([]*awaitReply, 0, len(m.awaitMap))
+	for r := range m.awaitMap {
+		awaits = append(awaits, r)
+	}
+	m.awaitLock.Unlock()
+
+	for _, r := range awaits {
+		r.done(nil, MODULE_CLOSED_ERR)
+	}
+}
+
 func (m *module) doClose(wait *sync.WaitGroup) {
+	atomic.StoreInt32(&m.closeFlag, 1)
+	m.failAwaits()
 	for _, c := range m.componentMap {
 		c.Close()
 	}
 	for _, a := range m.agentMap {
-		a.Close()
+		if l, ok := a.(network.NetLinker); ok == true {
+			l.CloseWithReason(network.CLOSE_SHUTDOWN, "module closed")
+		} else {
+			a.Close()
+		}
 	}
 	if PerfomancePrint == true {
 		elaspTime := time.Now().UnixNano()/1e9 - m.beginTime
@@ -265,6 +465,8 @@ func (m *module) handleEvent(eventMsg EventMsg) {
 		m.handleAgentEnter(eventMsg)
 	case event.EVENT_TCP_CLOSED:
 		m.handleAgentClosed(eventMsg)
+	case event.EVENT_TCP_THROTTLED:
+		m.handleAgentThrottled(eventMsg)
 	case event.EVENT_MODULE_RPC:
 		m.handleRpc(eventMsg)
 	case event.EVENT_MODULE_AWAITRPC:
@@ -287,6 +489,9 @@ func (m *module) handleDataEvent(eventMsg EventMsg) {
 	} else {
 		slog.LogError("module", "module [%s] unregister msg handler msg type id[%d] %v!", m.name, dataEventMsg.TypeID, ok)
 	}
+	if b, ok := dataEventMsg.MsgData.(*network.MsgBuffer); ok == true {
+		b.Release()
+	}
 	eventMsg.Reset()
 	m.dataMsgPool.Put(eventMsg)
 }
@@ -350,6 +555,17 @@ func (m *module) handleAgentClosed(eventMsg EventMsg) {
 	slog.LogError("agent", "module[%v] agent closed not found pakage[%v]", m.name, s.Cid)
 }
 
+func (m *module) handleAgentThrottled(eventMsg EventMsg) {
+	s := eventMsg.(*SessionEventMsg)
+	sender := s.Sender.(Agent)
+	if sesMgr, ok := m.commgrMap[s.Cid]; ok == true {
+		if h, ok := sesMgr.(ThrottleSessionMgr); ok == true {
+			action, _ := s.Args[0].(int)
+			h.OnLinkerThrottled(sender.GetID(), sender, action)
+		}
+	}
+}
+
 func (m *module) handleRpc(eventMsg EventMsg) {
 	rpcMsg := eventMsg.(*RpcEventMsg)
 	if handler, ok := m.rpcHandlerMap[rpcMsg.RpcName]; ok == true {
@@ -370,20 +586,32 @@ func (m *module) handleRpc(eventMsg EventMsg) {
 func (m *module) handleAwaitRpc(eventMsg EventMsg) {
 	rpcMsg := eventMsg.(*AwaitRpcEventMsg)
 	if handler, ok := m.rpcHandlerMap[rpcMsg.RpcName]; ok == true {
-		ctx := &ModuleContext{}
-		args := &m.args
+		ctx := &ModuleContext{m: m}
 		ctx.s = rpcMsg.Sender
-		ctx.u = rpcMsg.Await
-		args.ref(rpcMsg.Data)
-		handler(ctx, args)
-		args.clear()
+		ctx.r = rpcMsg.Reply
+		m.callAwaitHandler(handler, ctx, rpcMsg.Data)
 	} else {
 		slog.LogError("module", "module [%v] unregister rpc handler! rpc name:[%v]", m.name, rpcMsg.RpcName)
+		rpcMsg.Reply(nil, MODULE_RPC_NOT_FOUND_ERR)
 	}
 	eventMsg.Reset()
 	m.awaitMsgPool.Put(rpcMsg)
 }
 
+func (m *module) callAwaitHandler(handler RpcHandler, ctx *ModuleContext, data []interface{}) {
+	args := &m.args
+	defer func() {
+		if r := recover(); r != nil {
+			args.clear()
+			ctx.reply(nil, MODULE_RPC_PANIC_ERR)
+			panic(r)
+		}
+	}()
+	args.ref(data)
+	handler(ctx, args)
+	args.clear()
+}
+
 func (m *module) handleCustomAction(eventMsg EventMsg) {
 	customMsg := eventMsg.(CustomActionEventMsg)
 	action := customMsg.GetAction()
@@ -0,0 +1,114 @@
+package module
+
+import (
+	"bytes"
+	"errors"
+	"github.com/Cyinx/einx/slog"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	MODULE_AWAIT_SELF_ERR     = errors.New("module await rpc on itself.")
+	MODULE_AWAIT_DEADLOCK_ERR = errors.New("module await rpc deadlock.")
+)
+
+// awaitTracker records which module event loop runs on which goroutine and which
+// module every blocked loop is awaiting, so AwaitRpcCall can refuse a call that
+// would close a wait cycle instead of freezing both loops.
+type awaitTracker struct {
+	lock    sync.Mutex
+	runners map[uint64]*module
+	waits   map[*module]*module
+}
+
+var awaitGraph = &awaitTracker{
+	runners: make(map[uint64]*module),
+	waits:   make(map[*module]*module),
+}
+
+func goroutineID() uint64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	b := bytes.TrimPrefix(buf[:n], []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
+
+func (t *awaitTracker) addRunner(gid uint64, m *module) {
+	t.lock.Lock()
+	t.runners[gid] = m
+	t.lock.Unlock()
+}
+
+func (t *awaitTracker) removeRunner(gid uint64) {
+	t.lock.Lock()
+	if m, ok := t.runners[gid]; ok == true {
+		delete(t.runners, gid)
+		delete(t.waits, m)
+	}
+	t.lock.Unlock()
+}
+
+// begin marks the calling module loop as waiting on target. It returns the caller
+// (nil when not called from a module loop) and an error if the wait would deadlock.
+func (t *awaitTracker) begin(target *module) (*module, error) {
+	gid := goroutineID()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	caller, ok := t.runners[gid]
+	if ok == false {
+		return nil, nil
+	}
+
+	if caller == target {
+		slog.LogError("module", "module [%s] await rpc on itself refused", caller.name)
+		return caller, MODULE_AWAIT_SELF_ERR
+	}
+
+	path := []string{caller.name, target.name}
+	for next := t.waits[target]; next != nil; next = t.waits[next] {
+		path = append(path, next.name)
+		if next == caller {
+			slog.LogError("module", "module await rpc deadlock refused: [%s]", strings.Join(path, "] -> ["))
+			return caller, MODULE_AWAIT_DEADLOCK_ERR
+		}
+	}
+
+	t.waits[caller] = target
+	return caller, nil
+}
+
+func (t *awaitTracker) end(caller *module) {
+	if caller == nil {
+		return
+	}
+	t.lock.Lock()
+	delete(t.waits, caller)
+	t.lock.Unlock()
+}
+
+// awaitReply is the reply of one await rpc routed to module m. It stays in the
+// awaitMap of m until it is called, by the handler, the caller giving up or m
+// closing, whichever comes first; later calls are no-ops.
+type awaitReply struct {
+	m       *module
+	replied int32
+	reply   func([]interface{}, error)
+}
+
+func (r *awaitReply) done(results []interface{}, err error) {
+	if atomic.CompareAndSwapInt32(&r.replied, 0, 1) == false {
+		return
+	}
+	r.m.removeAwait(r)
+	r.reply(results, err)
+}
@@ -1,19 +1,24 @@
 package module
 
+import (
+	"sync/atomic"
+)
+
 type ModuleContext struct {
 	m Module
 	s Agent
 	c Component
 	t interface{}
 	v map[int]interface{}
-	u chan []interface{}
+	r func([]interface{}, error)
+	d int32
 }
 
 func (c *ModuleContext) Reset() {
 	c.s = nil
 	c.c = nil
 	c.t = nil
-	c.u = nil
+	c.r = nil
 }
 
 func (c *ModuleContext) GetModule() Module {
@@ -48,10 +53,14 @@ func (c *ModuleContext) Get(k int) interface{} {
 }
 
 func (c *ModuleContext) Done(args ...interface{}) {
-	if c.u == nil {
+	c.reply(args, nil)
+}
+
+func (c *ModuleContext) reply(results []interface{}, err error) {
+	if c.r == nil || atomic.CompareAndSwapInt32(&c.d, 0, 1) == false {
 		return
 	}
-	c.u <- args
+	c.r(results, err)
 }
 
 type ArgsVar struct {
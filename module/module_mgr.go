@@ -45,6 +45,7 @@ func NewModule(name string) Module {
 		dataMsgPool:   &sync.Pool{New: func() interface{} { return new(DataEventMsg) }},
 		eventMsgPool:  &sync.Pool{New: func() interface{} { return new(SessionEventMsg) }},
 		awaitMsgPool:  &sync.Pool{New: func() interface{} { return new(AwaitRpcEventMsg) }},
+		awaitMap:      make(map[*awaitReply]bool),
 		closeChan:     make(chan bool),
 		eventList:     make([]interface{}, MODULE_EVENT_LENGTH),
 	}
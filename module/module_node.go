@@ -0,0 +1,341 @@
+package module
+
+import (
+	gocontext "context"
+	"errors"
+	"github.com/Cyinx/einx/network"
+	"github.com/Cyinx/einx/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+type NetLinker = network.NetLinker
+
+const (
+	NODE_MSG_HANDSHAKE ProtoTypeID = iota + 1
+	NODE_MSG_RPC
+	NODE_MSG_RPC_RESULT
+)
+
+// NODE_RPC_TIMEOUT bounds AwaitRpcCall and AsyncRpcCall to a remote module, in
+// milliseconds, so a peer that never answers can not hang the caller.
+const NODE_RPC_TIMEOUT = 30 * 1000
+
+var (
+	NODE_NOT_LINKED_ERR       = errors.New("node not linked.")
+	NODE_MODULE_NOT_FOUND_ERR = errors.New("node module not found.")
+)
+
+var nodeName string = ""
+var nodeLinks = &nodeRegistry{links: make(map[string]NetLinker)}
+var remote_module_map sync.Map
+
+func SetNodeName(name string) {
+	nodeName = name
+}
+
+func GetNodeName() string {
+	return nodeName
+}
+
+type nodeRegistry struct {
+	lock  sync.RWMutex
+	links map[string]NetLinker
+}
+
+func (r *nodeRegistry) add(name string, linker NetLinker) {
+	r.lock.Lock()
+	if old, ok := r.links[name]; ok == true && old.GetID() != linker.GetID() {
+		slog.LogWarning("node", "node [%s] linked again, old link [%v] replaced", name, old.GetID())
+	}
+	r.links[name] = linker
+	r.lock.Unlock()
+}
+
+func (r *nodeRegistry) remove(name string, linker NetLinker) {
+	r.lock.Lock()
+	if old, ok := r.links[name]; ok == true && old.GetID() == linker.GetID() {
+		delete(r.links, name)
+	}
+	r.lock.Unlock()
+}
+
+func (r *nodeRegistry) get(name string) NetLinker {
+	r.lock.RLock()
+	linker := r.links[name]
+	r.lock.RUnlock()
+	return linker
+}
+
+func splitModuleAddr(addr string) (string, string) {
+	i := strings.IndexByte(addr, '/')
+	if i < 0 {
+		return "", addr
+	}
+	return addr[:i], addr[i+1:]
+}
+
+func marshalNodeRpc(moduleName string, rpcName string, args []interface{}) []byte {
+	b := network.RpcMarshal(nil, moduleName)
+	b = network.RpcMarshal(b, rpcName)
+	return network.RpcMarshal(b, args)
+}
+
+func unmarshalNodeRpc(b []byte) (string, string, []interface{}) {
+	var v interface{}
+	v, b = network.RpcUnMarshal(b)
+	moduleName, _ := v.(string)
+	v, b = network.RpcUnMarshal(b)
+	rpcName, _ := v.(string)
+	v, _ = network.RpcUnMarshal(b)
+	args, _ := v.([]interface{})
+	return moduleName, rpcName, args
+}
+
+// GetRemoteModule returns a Module for "node/module". RpcCall and AwaitRpcCall on it
+// are shipped over the node link registered by a NodeMgr and run on the remote node.
+func GetRemoteModule(addr string) Module {
+	node, name := splitModuleAddr(addr)
+	if node == "" || node == nodeName {
+		return GetModule(name)
+	}
+
+	if v, ok := remote_module_map.Load(addr); ok == true {
+		return v.(Module)
+	}
+
+	r := &remoteModule{
+		id:     GenModuleID(),
+		node:   node,
+		module: name,
+	}
+	v, _ := remote_module_map.LoadOrStore(addr, r)
+	return v.(Module)
+}
+
+type remoteModule struct {
+	id     AgentID
+	node   string
+	module string
+}
+
+func (r *remoteModule) GetID() AgentID {
+	return r.id
+}
+
+func (r *remoteModule) GetName() string {
+	return r.node + "/" + r.module
+}
+
+func (r *remoteModule) RpcCall(name string, args ...interface{}) {
+	linker := nodeLinks.get(r.node)
+	if linker == nil {
+		slog.LogWarning("node", "rpc [%s] to [%s] failed: node not linked", name, r.GetName())
+		return
+	}
+	linker.RpcCall(NODE_MSG_RPC, marshalNodeRpc(r.module, name, args))
+}
+
+func (r *remoteModule) AwaitRpcCall(name string, args ...interface{}) []interface{} {
+	results, err := r.AwaitRpcCallTimeout(NODE_RPC_TIMEOUT*time.Millisecond, name, args...)
+	if err != nil {
+		slog.LogWarning("node", "await rpc [%s] to [%s] failed: %v", name, r.GetName(), err)
+	}
+	return results
+}
+
+func (r *remoteModule) AwaitRpcCallTimeout(timeout time.Duration, name string, args ...interface{}) ([]interface{}, error) {
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), timeout)
+	defer cancel()
+	return r.AwaitRpcCallContext(ctx, name, args...)
+}
+
+func (r *remoteModule) AwaitRpcCallContext(ctx gocontext.Context, name string, args ...interface{}) ([]interface{}, error) {
+	linker := nodeLinks.get(r.node)
+	if linker == nil {
+		return nil, NODE_NOT_LINKED_ERR
+	}
+	b, err := linker.AwaitRpcRequest(ctx, NODE_MSG_RPC, marshalNodeRpc(r.module, name, args))
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalNodeResult(b)
+}
+
+func (r *remoteModule) AsyncRpcCall(target Module, name string, args []interface{}, cb AsyncRpcCallback) {
+	slog.LogError("node", "remote module [%s] can not be the caller of async rpc [%s]", r.GetName(), name)
+}
+
+func (r *remoteModule) asyncRpcCall(name string, args []interface{}, reply func([]interface{}, error)) {
+	linker := nodeLinks.get(r.node)
+	if linker == nil {
+		reply(nil, NODE_NOT_LINKED_ERR)
+		return
+	}
+	ok := linker.PostRpcRequest(NODE_MSG_RPC, marshalNodeRpc(r.module, name, args), NODE_RPC_TIMEOUT, func(_ ProtoTypeID, b []byte, err error) {
+		if err != nil {
+			reply(nil, err)
+			return
+		}
+		reply(unmarshalNodeResult(b))
+	})
+	if ok == false {
+		reply(nil, network.RPC_LINK_CLOSED_ERR)
+	}
+}
+
+func (r *remoteModule) AddTimer(delay uint64, op TimerHandler, args ...interface{}) uint64 {
+	slog.LogWarning("node", "remote module [%s] can not add timer", r.GetName())
+	return 0
+}
+
+func (r *remoteModule) RemoveTimer(timerId uint64) bool {
+	return false
+}
+
+// NodeMgr is the session manager of links between einx nodes. Add it to a module
+// with AddTcpServerMgr and/or StartTcpClientMgr, then ConnectNode to the peers.
+type NodeMgr struct {
+	lock     sync.Mutex
+	client   network.ITcpClientMgr
+	waitList []string
+}
+
+func NewNodeMgr() *NodeMgr {
+	return &NodeMgr{}
+}
+
+func (n *NodeMgr) ConnectNode(addr string) {
+	n.lock.Lock()
+	client := n.client
+	if client == nil {
+		n.waitList = append(n.waitList, addr)
+	}
+	n.lock.Unlock()
+	if client != nil {
+		client.Connect(addr, addr)
+	}
+}
+
+func (n *NodeMgr) OnComponentCreate(ctx Context, id ComponentID) {
+	client, ok := ctx.GetComponent().(network.ITcpClientMgr)
+	if ok == false {
+		return
+	}
+	n.lock.Lock()
+	n.client = client
+	waitList := n.waitList
+	n.waitList = nil
+	n.lock.Unlock()
+	for _, addr := range waitList {
+		client.Connect(addr, addr)
+	}
+}
+
+func (n *NodeMgr) OnComponentError(ctx Context, err error) {
+	slog.LogError("node", "node link [%v] error: %v", ctx.GetAttach(), err)
+}
+
+func (n *NodeMgr) OnLinkerConnected(id AgentID, agent Agent) {
+	if nodeName == "" {
+		slog.LogWarning("node", "node name not set, node link [%v] handshake with empty name", id)
+	}
+	linker := agent.(NetLinker)
+	linker.RpcCall(NODE_MSG_HANDSHAKE, network.RpcMarshal(nil, nodeName))
+}
+
+func (n *NodeMgr) OnLinkerClosed(id AgentID, agent Agent, err error) {
+	linker := agent.(NetLinker)
+	if name, ok := linker.GetUserType().(string); ok == true {
+		nodeLinks.remove(name, linker)
+		slog.LogInfo("node", "node [%s] link [%v] closed: %v", name, id, err)
+	}
+}
+
+func (n *NodeMgr) ServeHandler(agent Agent, id ProtoTypeID, b []byte) {
+	slog.LogWarning("node", "node link [%v] unexpected msg [%v]", agent.GetID(), id)
+}
+
+func (n *NodeMgr) ServeRpc(agent Agent, id ProtoTypeID, b []byte) {
+	linker := agent.(NetLinker)
+	switch id {
+	case NODE_MSG_HANDSHAKE:
+		v, _ := network.RpcUnMarshal(b)
+		name, _ := v.(string)
+		linker.SetUserType(name)
+		nodeLinks.add(name, linker)
+		slog.LogInfo("node", "node [%s] linked by [%v]", name, linker.RemoteAddr())
+	case NODE_MSG_RPC:
+		moduleName, rpcName, args := unmarshalNodeRpc(b)
+		m := FindModule(moduleName)
+		if m == nil {
+			slog.LogWarning("node", "rpc [%s] to unknown module [%s]", rpcName, moduleName)
+			return
+		}
+		m.(ModuleRouter).RouterRpc(agent, rpcName, args)
+	default:
+		slog.LogWarning("node", "node link [%v] unknown rpc [%v]", agent.GetID(), id)
+	}
+}
+
+func (n *NodeMgr) ServeRpcRequest(agent Agent, id ProtoTypeID, seqID uint32, b []byte) {
+	linker := agent.(NetLinker)
+	if id != NODE_MSG_RPC {
+		slog.LogWarning("node", "node link [%v] unknown rpc request [%v]", agent.GetID(), id)
+		linker.RpcReply(seqID, NODE_MSG_RPC_RESULT, marshalNodeResult(nil, MODULE_RPC_NOT_FOUND_ERR))
+		return
+	}
+
+	moduleName, rpcName, args := unmarshalNodeRpc(b)
+	m, ok := FindModule(moduleName).(*module)
+	if ok == false {
+		slog.LogWarning("node", "await rpc [%s] to unknown module [%s]", rpcName, moduleName)
+		linker.RpcReply(seqID, NODE_MSG_RPC_RESULT, marshalNodeResult(nil, NODE_MODULE_NOT_FOUND_ERR))
+		return
+	}
+
+	m.routerAwaitRpc(agent, rpcName, args, func(results []interface{}, err error) {
+		linker.RpcReply(seqID, NODE_MSG_RPC_RESULT, marshalNodeResult(results, err))
+	})
+}
+
+var nodeErrors = []error{
+	MODULE_CLOSED_ERR,
+	MODULE_RPC_NOT_FOUND_ERR,
+	MODULE_RPC_PANIC_ERR,
+	NODE_MODULE_NOT_FOUND_ERR,
+}
+
+func marshalNodeResult(results []interface{}, err error) (b []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.LogError("node", "marshal rpc results error: %v", r)
+			b = network.RpcMarshal(network.RpcMarshal(nil, "unsupported rpc result type"), nil)
+		}
+	}()
+	errString := ""
+	if err != nil {
+		errString = err.Error()
+	}
+	if results == nil {
+		results = []interface{}{}
+	}
+	return network.RpcMarshal(network.RpcMarshal(nil, errString), results)
+}
+
+func unmarshalNodeResult(b []byte) ([]interface{}, error) {
+	var v interface{}
+	v, b = network.RpcUnMarshal(b)
+	if errString, _ := v.(string); errString != "" {
+		for _, err := range nodeErrors {
+			if err.Error() == errString {
+				return nil, err
+			}
+		}
+		return nil, errors.New(errString)
+	}
+	v, _ = network.RpcUnMarshal(b)
+	results, _ := v.([]interface{})
+	return results, nil
+}
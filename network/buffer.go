@@ -38,6 +38,11 @@ func (b *BytesBuffer) WriteUint8(m byte) int {
 	return b.write(1)
 }
 
+func (b *BytesBuffer) WriteUint16(i uint16) int {
+	bigEndian.PutUint16(b.buf[b.w:], i)
+	return b.write(2)
+}
+
 func (b *BytesBuffer) WriteUint32(i uint32) int {
 	bigEndian.PutUint32(b.buf[b.w:], i)
 	return b.write(4)
@@ -0,0 +1,159 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CLOSE_NORMAL = iota
+	CLOSE_PEER_CLOSED
+	CLOSE_PING_TIMEOUT
+	CLOSE_OVERSIZE
+	CLOSE_RATE_LIMIT
+	CLOSE_SHUTDOWN
+	CLOSE_PROTOCOL_ERROR
+	CLOSE_WRITE_QUEUE_FULL
+	CLOSE_IO_ERROR
+)
+
+const (
+	MSG_CLOSE_CODE_LENGTH = 2
+	MSG_CLOSE_REASON_MAX  = 128
+)
+
+var closeCodeNames = map[int]string{
+	CLOSE_NORMAL:           "normal",
+	CLOSE_PEER_CLOSED:      "peer closed",
+	CLOSE_PING_TIMEOUT:     "ping timeout",
+	CLOSE_OVERSIZE:         "oversize packet",
+	CLOSE_RATE_LIMIT:       "rate limit",
+	CLOSE_SHUTDOWN:         "shutdown",
+	CLOSE_PROTOCOL_ERROR:   "protocol error",
+	CLOSE_WRITE_QUEUE_FULL: "write queue full",
+	CLOSE_IO_ERROR:         "io error",
+}
+
+// CloseReason is the error a linker's Run returns and SessionMgr.OnLinkerClosed
+// receives. Remote is set when the peer sent it in a 'C' close frame.
+type CloseReason struct {
+	Code   int
+	Msg    string
+	Remote bool
+	Err    error
+}
+
+func (r *CloseReason) Error() string {
+	s := closeCodeNames[r.Code]
+	if s == "" {
+		s = fmt.Sprintf("code %d", r.Code)
+	}
+	if r.Remote == true {
+		s = "remote " + s
+	}
+	if r.Msg != "" {
+		s += ": " + r.Msg
+	}
+	if r.Err != nil {
+		s += " (" + r.Err.Error() + ")"
+	}
+	return s
+}
+
+func (r *CloseReason) Unwrap() error {
+	return r.Err
+}
+
+func newCloseReason(code int, err error) *CloseReason {
+	return &CloseReason{Code: code, Err: err}
+}
+
+func recvCloseReason(err error) *CloseReason {
+	var netErr net.Error
+	switch {
+	case err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed):
+		return newCloseReason(CLOSE_PEER_CLOSED, err)
+	case err == MSG_TOO_LONG_ERR || err == MSG_FRAGMENT_TOTAL_ERR:
+		return newCloseReason(CLOSE_OVERSIZE, err)
+	case errors.As(err, &netErr):
+		return newCloseReason(CLOSE_IO_ERROR, err)
+	}
+	return newCloseReason(CLOSE_PROTOCOL_ERROR, err)
+}
+
+// CloseWithReason closes the linker with code and msg as its CloseReason. Msgs already
+// queued are flushed; with TransportLinger they are followed by a 'C' close frame and
+// the write side is shut, giving the peer up to the linger time to close its end.
+func (n *TcpConn) CloseWithReason(code int, msg string) {
+	atomic.StoreInt32(&n.userClose, 1)
+	n.closeWithReason(&CloseReason{Code: code, Msg: msg})
+}
+
+func (n *TcpConn) closeWithReason(r *CloseReason) {
+	if n.IsClosed() == true {
+		return
+	}
+	n.setCloseReason(r)
+	atomic.StoreInt32(&n.graceful, 1)
+	if linger := n.option.linger; linger > 0 {
+		_ = n.conn.SetWriteDeadline(time.Now().Add(linger))
+	}
+	if n.option.close_frame == true {
+		w := writePool.Get().(*TransportMsgPack)
+		w.msgType = 'C'
+		w.msgID = uint32(r.Code)
+		if len(r.Msg) > MSG_CLOSE_REASON_MAX {
+			w.Buf = []byte(r.Msg[:MSG_CLOSE_REASON_MAX])
+		} else {
+			w.Buf = []byte(r.Msg)
+		}
+		n.writeQueue.Push(w, 0, 0, 0)
+	}
+	n.doClose()
+}
+
+func (n *TcpConn) isGraceful() bool {
+	return atomic.LoadInt32(&n.graceful) == 1
+}
+
+func (n *tcpTransport) packCloseMsg(msg *TransportMsgPack) {
+	bodyLength := MSG_CLOSE_CODE_LENGTH + len(msg.Buf)
+	buf := n.writeBuf
+	buf.Reserve(bodyLength + MSG_HEADER_LENGTH_V2)
+	n.writeHeader(buf, n.getWireVersion(), 'C', 0, bodyLength)
+	buf.WriteUint16(uint16(msg.msgID))
+	buf.WriteBytes(msg.Buf)
+}
+
+func (n *tcpTransport) onCloseMsg(b []byte) {
+	n.setCloseReason(&CloseReason{
+		Code:   int(bigEndian.Uint16(b)),
+		Msg:    string(b[MSG_CLOSE_CODE_LENGTH:]),
+		Remote: true,
+	})
+}
+
+// lingerClose shuts the write side after a graceful close and lets the read loop
+// run until the peer closes or the linger time is over. Conns that can not be
+// half closed are released at once, their pending writes have been flushed.
+func (n *TcpConn) lingerClose() {
+	linger := n.option.linger
+	c, ok := n.conn.(interface{ CloseWrite() error })
+	if linger <= 0 || ok == false || c.CloseWrite() != nil {
+		n.Destroy()
+		return
+	}
+	_ = n.conn.SetReadDeadline(time.Now().Add(linger))
+}
+
+// exitLoop is called by the read and the write loop when they end, the last one
+// out releases the connection.
+func (n *TcpConn) exitLoop() {
+	if atomic.AddInt32(&n.loops, -1) == 0 {
+		n.Destroy()
+	}
+}
@@ -0,0 +1,209 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Cyinx/einx/event"
+	"github.com/Cyinx/einx/slog"
+	"reflect"
+	"sync"
+)
+
+var (
+	CODEC_NOT_REGISTERED_ERR = errors.New("codec msg id not registered.")
+	CODEC_TYPE_ERR           = errors.New("codec msg type mismatch.")
+)
+
+type MsgCodec interface {
+	Marshal(interface{}) ([]byte, error)
+	Unmarshal([]byte, interface{}) error
+}
+
+type TypedSessionHandler interface {
+	ServeMsg(Agent, ProtoTypeID, interface{})
+}
+
+type jsonCodec struct{}
+
+func (c jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c jsonCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+// protoCodec works with generated messages exposing Marshal/Unmarshal methods
+// (gogo protobuf, or any hand written message).
+type protoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal([]byte) error
+}
+
+type protoCodec struct{}
+
+func (c protoCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(protoMessage); ok == true {
+		return m.Marshal()
+	}
+	return nil, CODEC_TYPE_ERR
+}
+
+func (c protoCodec) Unmarshal(b []byte, v interface{}) error {
+	if m, ok := v.(protoMessage); ok == true {
+		return m.Unmarshal(b)
+	}
+	return CODEC_TYPE_ERR
+}
+
+type rpcCodec struct{}
+
+func (c rpcCodec) Marshal(v interface{}) (b []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("rpc codec marshal error: %v", r)
+		}
+	}()
+	return RpcMarshal(nil, v), nil
+}
+
+func (c rpcCodec) Unmarshal(b []byte, v interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("rpc codec unmarshal error: %v", r)
+		}
+	}()
+	val, _ := RpcUnMarshal(b)
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() == true {
+		return CODEC_TYPE_ERR
+	}
+	if val == nil {
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+		return nil
+	}
+	x := reflect.ValueOf(val)
+	if x.Type().AssignableTo(rv.Elem().Type()) == false {
+		return CODEC_TYPE_ERR
+	}
+	rv.Elem().Set(x)
+	return nil
+}
+
+var (
+	JsonCodec  MsgCodec = jsonCodec{}
+	ProtoCodec MsgCodec = protoCodec{}
+	RpcCodec   MsgCodec = rpcCodec{}
+)
+
+type codecEntry struct {
+	codec   MsgCodec
+	msgType reflect.Type
+	isPtr   bool
+}
+
+type CodecRegistry struct {
+	lock    sync.RWMutex
+	entries map[ProtoTypeID]*codecEntry
+}
+
+func NewCodecRegistry() *CodecRegistry {
+	return &CodecRegistry{
+		entries: make(map[ProtoTypeID]*codecEntry),
+	}
+}
+
+// Register binds msgID to the Go type of msg and the codec used for it. Received
+// packets are decoded into a new value of that type (a pointer if msg is a pointer).
+func (r *CodecRegistry) Register(msgID ProtoTypeID, msg interface{}, codec MsgCodec) {
+	t := reflect.TypeOf(msg)
+	if t == nil || codec == nil {
+		panic("codec register nil msg type or codec")
+	}
+	e := &codecEntry{codec: codec, msgType: t}
+	if t.Kind() == reflect.Ptr {
+		e.isPtr = true
+		e.msgType = t.Elem()
+	}
+
+	r.lock.Lock()
+	if _, ok := r.entries[msgID]; ok == true {
+		slog.LogWarning("codec", "MsgID[%d] codec has been registered", msgID)
+	}
+	r.entries[msgID] = e
+	r.lock.Unlock()
+}
+
+func (r *CodecRegistry) get(msgID ProtoTypeID) *codecEntry {
+	r.lock.RLock()
+	e := r.entries[msgID]
+	r.lock.RUnlock()
+	return e
+}
+
+func (r *CodecRegistry) IsRegistered(msgID ProtoTypeID) bool {
+	return r.get(msgID) != nil
+}
+
+func (r *CodecRegistry) Decode(msgID ProtoTypeID, b []byte) (interface{}, error) {
+	e := r.get(msgID)
+	if e == nil {
+		return nil, CODEC_NOT_REGISTERED_ERR
+	}
+	v := reflect.New(e.msgType)
+	if err := e.codec.Unmarshal(b, v.Interface()); err != nil {
+		return nil, err
+	}
+	if e.isPtr == true {
+		return v.Interface(), nil
+	}
+	return v.Elem().Interface(), nil
+}
+
+func (r *CodecRegistry) Encode(msgID ProtoTypeID, msg interface{}) ([]byte, error) {
+	e := r.get(msgID)
+	if e == nil {
+		return nil, CODEC_NOT_REGISTERED_ERR
+	}
+	return e.codec.Marshal(msg)
+}
+
+func (n *TcpConn) SendMsg(msgID ProtoTypeID, msg interface{}) bool {
+	codec := n.option.codec
+	if codec == nil {
+		slog.LogWarning("codec", "linker [%v] send msg [%d] without codec registry", n.agentID, msgID)
+		return false
+	}
+	b, err := codec.Encode(msgID, msg)
+	if err != nil {
+		slog.LogWarning("codec", "linker [%v] encode msg [%d] error: %v", n.agentID, msgID, err)
+		return false
+	}
+	return n.WriteMsg(msgID, b)
+}
+
+func (n *TcpConn) serveMsg(msgID ProtoTypeID, b []byte) error {
+	codec := n.option.codec
+	if codec == nil || codec.IsRegistered(msgID) == false {
+		if h, ok := n.serveHandler.(BufferSessionHandler); ok == true && n.readMsg != nil {
+			h.ServeBuffer(n, msgID, n.readMsg)
+		} else {
+			n.serveHandler.ServeHandler(n, msgID, b)
+		}
+		return nil
+	}
+
+	msg, err := codec.Decode(msgID, b)
+	if err != nil {
+		slog.LogWarning("codec", "linker [%v] decode msg [%d] error: %v", n.agentID, msgID, err)
+		return err
+	}
+
+	if h, ok := n.serveHandler.(TypedSessionHandler); ok == true {
+		h.ServeMsg(n, msgID, msg)
+	} else if n.module != nil {
+		n.module.PostData(event.EVENT_TCP_READ_MSG, msgID, n, msg)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package network
+
+import (
+	"sync"
+)
+
+// groupFrame is one broadcast msg. The v2 packet is encoded once and the same
+// frame is queued to every member; links that need a different encoding (v1,
+// encryption, compression or fragmentation) pack the shared body themselves.
+type groupFrame struct {
+	msgID ProtoTypeID
+	body  []byte
+	frame []byte
+}
+
+func newGroupFrame(msgID ProtoTypeID, b []byte) *groupFrame {
+	bodyLength := len(b) + MSG_ID_LENGTH
+	frame := make([]byte, MSG_HEADER_LENGTH_V2+bodyLength)
+	frame[0] = MSG_MAGIC_V2
+	frame[1] = 'P'
+	frame[2] = 0
+	bigEndian.PutUint32(frame[3:], uint32(bodyLength))
+	bigEndian.PutUint32(frame[MSG_HEADER_LENGTH_V2:], msgID)
+	copy(frame[MSG_HEADER_LENGTH_V2+MSG_ID_LENGTH:], b)
+	return &groupFrame{
+		msgID: msgID,
+		body:  frame[MSG_HEADER_LENGTH_V2+MSG_ID_LENGTH:],
+		frame: frame,
+	}
+}
+
+func (f *groupFrame) GetType() byte {
+	return 'G'
+}
+
+// reset is a no-op: the frame is shared by all members and left to the GC.
+func (f *groupFrame) reset() {
+}
+
+func (n *tcpTransport) packGroupMsg(f *groupFrame) {
+	bodyLength := len(f.body) + MSG_ID_LENGTH
+	threshold := n.option.compress_threshold
+	fragLength := n.fragmentLength()
+	if n.crypto == nil && n.getWireVersion() == MSG_VERSION_2 &&
+		(threshold <= 0 || bodyLength < threshold) && (fragLength <= 0 || bodyLength <= fragLength) {
+		buf := n.writeBuf
+		buf.Reserve(len(f.frame))
+		buf.WriteBytes(f.frame)
+		return
+	}
+
+	msg := TransportMsgPack{msgType: 'P', msgID: f.msgID, Buf: f.body}
+	n.packMsgBuf(&msg)
+}
+
+type Group struct {
+	name    string
+	lock    sync.RWMutex
+	members map[AgentID]*TcpConn
+}
+
+var groupLock sync.Mutex
+var groupMap = make(map[string]*Group)
+
+// GetGroup returns the group called name, creating it on first use.
+func GetGroup(name string) *Group {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+	g, ok := groupMap[name]
+	if ok == false {
+		g = &Group{name: name, members: make(map[AgentID]*TcpConn)}
+		groupMap[name] = g
+	}
+	return g
+}
+
+// RemoveGroup drops the group called name and all its memberships.
+func RemoveGroup(name string) {
+	groupLock.Lock()
+	g, ok := groupMap[name]
+	delete(groupMap, name)
+	groupLock.Unlock()
+	if ok == false {
+		return
+	}
+
+	g.lock.Lock()
+	members := g.members
+	g.members = make(map[AgentID]*TcpConn)
+	g.lock.Unlock()
+	for _, n := range members {
+		n.removeGroup(g)
+	}
+}
+
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Join adds l to the group, a linker leaves all its groups when it closes.
+func (g *Group) Join(l NetLinker) bool {
+	n, ok := l.(*TcpConn)
+	if ok == false {
+		return false
+	}
+	n.addGroup(g)
+	g.lock.Lock()
+	g.members[n.agentID] = n
+	g.lock.Unlock()
+
+	if n.IsClosed() == true {
+		g.Leave(n)
+		return false
+	}
+	return true
+}
+
+func (g *Group) Leave(l NetLinker) {
+	n, ok := l.(*TcpConn)
+	if ok == false {
+		return
+	}
+	g.lock.Lock()
+	delete(g.members, n.agentID)
+	g.lock.Unlock()
+	n.removeGroup(g)
+}
+
+func (g *Group) Count() int {
+	g.lock.RLock()
+	c := len(g.members)
+	g.lock.RUnlock()
+	return c
+}
+
+// Broadcast queues msgID to every member and returns how many accepted it.
+func (g *Group) Broadcast(msgID ProtoTypeID, b []byte) int {
+	return g.BroadcastExcept(msgID, b, 0)
+}
+
+// BroadcastExcept is Broadcast skipping the linker with agent id except.
+func (g *Group) BroadcastExcept(msgID ProtoTypeID, b []byte, except AgentID) int {
+	f := newGroupFrame(msgID, b)
+	count := 0
+	g.lock.RLock()
+	for id, n := range g.members {
+		if id != except && n.pushGroupMsg(f) == true {
+			count++
+		}
+	}
+	g.lock.RUnlock()
+	return count
+}
+
+// Multicast queues msgID to each of linkers, encoding the packet once.
+func Multicast(linkers []NetLinker, msgID ProtoTypeID, b []byte) int {
+	f := newGroupFrame(msgID, b)
+	count := 0
+	for _, l := range linkers {
+		if n, ok := l.(*TcpConn); ok == true && n.pushGroupMsg(f) == true {
+			count++
+		}
+	}
+	return count
+}
+
+func (n *TcpConn) pushGroupMsg(f *groupFrame) bool {
+	if n.IsClosed() == true {
+		return false
+	}
+	return n.doPushWrite(f)
+}
+
+func (n *TcpConn) addGroup(g *Group) {
+	n.groupLock.Lock()
+	if n.groups == nil {
+		n.groups = make(map[*Group]bool)
+	}
+	n.groups[g] = true
+	n.groupLock.Unlock()
+}
+
+func (n *TcpConn) removeGroup(g *Group) {
+	n.groupLock.Lock()
+	delete(n.groups, g)
+	n.groupLock.Unlock()
+}
+
+func (n *TcpConn) leaveGroups() {
+	n.groupLock.Lock()
+	groups := n.groups
+	n.groups = nil
+	n.groupLock.Unlock()
+	for g := range groups {
+		g.lock.Lock()
+		delete(g.members, n.agentID)
+		g.lock.Unlock()
+	}
+}
@@ -0,0 +1,85 @@
+package network
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	MSG_POOL_BUFFER_MAX = 64 * 1024
+)
+
+var msgBufferPool *sync.Pool = &sync.Pool{New: func() interface{} { return new(MsgBuffer) }}
+
+// BufferSessionHandler is an optional SessionHandler extension receiving msgs as
+// pooled buffers instead of plain slices.
+type BufferSessionHandler interface {
+	ServeBuffer(Agent, ProtoTypeID, *MsgBuffer)
+}
+
+// MsgBuffer owns the body of one received msg, read straight into a pooled buffer.
+// Ownership model: the linker holds a reference while the handler runs and drops
+// it once the handler returns, so Bytes() is only valid during the call. To keep
+// the msg, Retain it first and Release it when done; a MsgBuffer passed to a
+// module through RouterMsg is released by the module after its msg handler runs,
+// so Retain before routing it. Release must be called once per reference.
+type MsgBuffer struct {
+	ref  int32
+	buf  *BytesBuffer
+	data []byte
+}
+
+func newMsgBuffer(buf *BytesBuffer, data []byte) *MsgBuffer {
+	b := msgBufferPool.Get().(*MsgBuffer)
+	b.ref = 1
+	b.buf = buf
+	b.data = data
+	return b
+}
+
+func (b *MsgBuffer) Bytes() []byte {
+	return b.data
+}
+
+func (b *MsgBuffer) Len() int {
+	return len(b.data)
+}
+
+func (b *MsgBuffer) Retain() *MsgBuffer {
+	if atomic.AddInt32(&b.ref, 1) <= 1 {
+		panic("msg buffer retained after release")
+	}
+	return b
+}
+
+func (b *MsgBuffer) Release() {
+	ref := atomic.AddInt32(&b.ref, -1)
+	if ref > 0 {
+		return
+	}
+	if ref < 0 {
+		panic("msg buffer released twice")
+	}
+	buf := b.buf
+	b.buf = nil
+	b.data = nil
+	putBuffer(buf)
+	msgBufferPool.Put(b)
+}
+
+// getBuffer takes an empty buffer of at least size bytes from bufferPool, buffers
+// are put back with their read and write offsets.
+func getBuffer(size int) *BytesBuffer {
+	buf := bufferPool.Get().(*BytesBuffer)
+	buf.Reset()
+	buf.Reserve(size)
+	return buf
+}
+
+// putBuffer returns buf to bufferPool unless it grew too large to be worth keeping.
+func putBuffer(buf *BytesBuffer) {
+	if buf == nil || len(buf.buf) > MSG_POOL_BUFFER_MAX {
+		return
+	}
+	bufferPool.Put(buf)
+}
@@ -1,10 +1,12 @@
 package network
 
 import (
+	"context"
 	"github.com/Cyinx/einx/agent"
 	"github.com/Cyinx/einx/component"
 	"github.com/Cyinx/einx/event"
 	"net"
+	"strings"
 )
 
 type Agent = agent.Agent
@@ -20,6 +22,17 @@ func GenComponentID() ComponentID {
 	return component.GenComponentID()
 }
 
+const UNIX_ADDR_PREFIX = "unix:"
+
+// splitAddr returns the network and address to listen on or dial: "unix:path" is
+// a unix domain socket, anything else a tcp address.
+func splitAddr(addr string) (string, string) {
+	if strings.HasPrefix(addr, UNIX_ADDR_PREFIX) == true {
+		return "unix", addr[len(UNIX_ADDR_PREFIX):]
+	}
+	return "tcp", addr
+}
+
 type ITcpServerMgr interface {
 	GetID() ComponentID
 	GetType() ComponentType
@@ -59,6 +72,7 @@ type ITransportMsg interface {
 type TransportMsgPack struct {
 	msgType byte
 	msgID   ProtoTypeID
+	seqID   uint32
 	Buf     []byte
 }
 
@@ -69,6 +83,7 @@ func (m *TransportMsgPack) GetType() byte {
 func (w *TransportMsgPack) reset() {
 	w.msgType = 0
 	w.msgID = 0
+	w.seqID = 0
 	w.Buf = nil
 
 	writePool.Put(w)
@@ -77,6 +92,8 @@ func (w *TransportMsgPack) reset() {
 type ITransporter interface {
 	IsClosed() bool
 	doPushWrite(ITransportMsg) bool
+	batchMaxSize() int
+	msgMaxSize() int
 }
 
 type ITranMsgMultiple interface {
@@ -85,9 +102,12 @@ type ITranMsgMultiple interface {
 	Done() bool
 }
 
+// TransportMultiple is a batch of msgs queued as one unit: Done queues all of them
+// or none, and the writer packs them back to back into the same flush.
 type TransportMultiple struct {
 	trans    ITransporter
 	count    int
+	done     bool
 	msgArray []*TransportMsgPack
 }
 
@@ -95,8 +115,28 @@ func (m *TransportMultiple) GetType() byte {
 	return 'B'
 }
 
+// canAdd refuses msgs the writer would drop on their own, so a batch is never
+// sent in part, and msgs that would take the batch over its size limit.
+func (m *TransportMultiple) canAdd(msgType byte, b []byte) bool {
+	if m.done == true || m.trans.IsClosed() == true {
+		return false
+	}
+	msgSize := len(b) + MSG_ID_LENGTH
+	if isRpcMsgType(msgType) == true {
+		msgSize += MSG_SEQ_LENGTH
+	}
+	if max := m.trans.msgMaxSize(); max > 0 && msgSize > max {
+		return false
+	}
+	size := m.count + len(b) + MSG_ID_LENGTH
+	if max := m.trans.batchMaxSize(); max > 0 && size > max {
+		return false
+	}
+	return true
+}
+
 func (m *TransportMultiple) WriteMsg(msgID ProtoTypeID, b []byte) bool {
-	if m.trans.IsClosed() == true {
+	if m.canAdd('P', b) == false {
 		return false
 	}
 
@@ -104,13 +144,13 @@ func (m *TransportMultiple) WriteMsg(msgID ProtoTypeID, b []byte) bool {
 	w.msgType = 'P'
 	w.msgID = msgID
 	w.Buf = b
-	m.count += len(b)
+	m.count += len(b) + MSG_ID_LENGTH
 	m.msgArray = append(m.msgArray, w)
 	return true
 }
 
 func (m *TransportMultiple) RpcCall(msgiD ProtoTypeID, b []byte) bool {
-	if m.trans.IsClosed() == true {
+	if m.canAdd('R', b) == false {
 		return false
 	}
 
@@ -118,17 +158,21 @@ func (m *TransportMultiple) RpcCall(msgiD ProtoTypeID, b []byte) bool {
 	w.msgType = 'R'
 	w.msgID = msgiD
 	w.Buf = b
-	m.count += len(b)
+	m.count += len(b) + MSG_ID_LENGTH
 	m.msgArray = append(m.msgArray, w)
 	return true
 }
 
 func (m *TransportMultiple) Done() bool {
-	if m.trans.IsClosed() == true {
+	if m.done == true {
 		return false
 	}
-	m.trans.doPushWrite(m)
-	return true
+	m.done = true
+	if m.trans.IsClosed() == true || len(m.msgArray) == 0 {
+		m.reset()
+		return false
+	}
+	return m.trans.doPushWrite(m)
 }
 
 func (b *TransportMultiple) reset() {
@@ -136,24 +180,35 @@ func (b *TransportMultiple) reset() {
 	msgArray := b.msgArray
 	b.msgArray = nil
 	for _, v := range msgArray {
-		writePool.Put(v)
+		v.reset()
 	}
 }
 
 const (
 	COMPONENT_TYPE_TCP_SERVER = component.COMPONENT_TYPE_TCP_SERVER
 	COMPONENT_TYPE_TCP_CLIENT = component.COMPONENT_TYPE_TCP_CLIENT
+	COMPONENT_TYPE_WS_SERVER  = component.COMPONENT_TYPE_WS_SERVER
+	COMPONENT_TYPE_UDP_SERVER = component.COMPONENT_TYPE_UDP_SERVER
+	COMPONENT_TYPE_UDP_CLIENT = component.COMPONENT_TYPE_UDP_CLIENT
 )
 
 type NetLinker interface {
 	GetID() AgentID
 	Close()
+	CloseWithReason(int, string)
 	RemoteAddr() net.Addr
 	WriteMsg(ProtoTypeID, []byte) bool
+	SendMsg(ProtoTypeID, interface{}) bool
 	RpcCall(ProtoTypeID, []byte) bool
+	RpcRequest(ProtoTypeID, []byte, uint64, RpcCallback) bool
+	PostRpcRequest(ProtoTypeID, []byte, uint64, RpcCallback) bool
+	AwaitRpcRequest(context.Context, ProtoTypeID, []byte) ([]byte, error)
+	RpcReply(uint32, ProtoTypeID, []byte) bool
 	MultipleMsg() ITranMsgMultiple
 	GetUserType() interface{}
 	SetUserType(interface{})
+	ReconnectCount() uint32
+	QueuedBytes() (int, int)
 	Run() error
 }
 
@@ -162,6 +217,12 @@ type SessionMgr interface {
 	OnLinkerClosed(AgentID, Agent, error)
 }
 
+// ThrottleSessionMgr is an optional SessionMgr extension, notified on the module
+// loop when a linker goes over its inbound msg rate, with the RATE_LIMIT_ action taken.
+type ThrottleSessionMgr interface {
+	OnLinkerThrottled(AgentID, Agent, int)
+}
+
 type SessionHandler interface {
 	ServeHandler(Agent, ProtoTypeID, []byte)
 	ServeRpc(Agent, ProtoTypeID, []byte)
@@ -1,22 +1,58 @@
 package network
 
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
 type TransportOption struct {
-	msg_max_length uint32
-	msg_max_count  int32 //max msg count per seconds
-	ping_time      int64
-	enable_ping    bool
+	msg_max_length     uint32
+	msg_max_count      int32 //max msg count per seconds, 0 is unlimited
+	ping_time          int64
+	enable_ping        bool
+	codec              *CodecRegistry
+	wire_version       int32
+	wire_compat        bool
+	compress_threshold int
+	encrypt            bool
+	msg_max_total      uint32
+	rate_limit_action  int
+	write_max_count    int
+	write_max_bytes    int
+	write_policy       int
+	write_flush_size   int
+	write_flush_delay  time.Duration
+	linger             time.Duration
+	close_frame        bool
+	batch_max_size     int
+	packet_codec       func() PacketCodec
 }
 
 func newTransportOption() TransportOption {
 	o := TransportOption{
-		msg_max_length: MSG_MAX_BODY_LENGTH,
-		msg_max_count:  MSG_DEFAULT_COUNT,
-		ping_time:      5 * 1000,
-		enable_ping:    true,
+		msg_max_length:    MSG_MAX_BODY_LENGTH,
+		ping_time:         5 * 1000,
+		enable_ping:       true,
+		wire_version:      MSG_VERSION_1,
+		wire_compat:       true,
+		rate_limit_action: RATE_LIMIT_DELAY,
+		write_policy:      WRITE_DROP_NEWEST,
+		write_flush_size:  MSG_DEFAULT_FLUSH_SIZE,
+		batch_max_size:    MSG_DEFAULT_BATCH_SIZE,
 	}
 	return o
 }
 
+// newClientTransportOption is newTransportOption with keep alive pings off, as
+// client links only ping once TransportKeepAlive enables it.
+func newClientTransportOption() TransportOption {
+	o := newTransportOption()
+	o.ping_time = 0
+	o.enable_ping = false
+	return o
+}
+
 type OptionMgr interface {
 	GetOption() *TransportOption
 }
@@ -31,6 +67,12 @@ func Name(name string) Option {
 			v.name = name
 		case *TcpClientMgr:
 			v.name = name
+		case *WsServerMgr:
+			v.name = name
+		case *UdpServerMgr:
+			v.name = name
+		case *UdpClientMgr:
+			v.name = name
 		default:
 			panic("option network name unknown type")
 		}
@@ -45,6 +87,12 @@ func Module(m EventReceiver) Option {
 			v.module = m
 		case *TcpClientMgr:
 			v.module = m
+		case *WsServerMgr:
+			v.module = m
+		case *UdpServerMgr:
+			v.module = m
+		case *UdpClientMgr:
+			v.module = m
 		default:
 			panic("option network module unknown type")
 		}
@@ -57,6 +105,10 @@ func ListenAddr(addr string) Option {
 		switch v := t.(type) {
 		case *TcpServerMgr:
 			v.addr = addr
+		case *WsServerMgr:
+			v.addr = addr
+		case *UdpServerMgr:
+			v.addr = addr
 		default:
 			panic("option network listen addr unknown type")
 		}
@@ -71,18 +123,173 @@ func ServeHandler(serve_handler SessionHandler) Option {
 			v.agentHandler = serve_handler
 		case *TcpClientMgr:
 			v.agent_handler = serve_handler
+		case *WsServerMgr:
+			v.agentHandler = serve_handler
+		case *UdpServerMgr:
+			v.agentHandler = serve_handler
+		case *UdpClientMgr:
+			v.agent_handler = serve_handler
 		default:
 			panic("option network serve handler unknown type")
 		}
 	}
 }
 
+func TLSConfig(cfg *tls.Config) Option {
+	return func(args ...interface{}) {
+		t := args[0]
+		switch v := t.(type) {
+		case *TcpServerMgr:
+			v.tlsConfig = cfg
+		case *TcpClientMgr:
+			v.tlsConfig = cfg
+		case *WsServerMgr:
+			v.tlsConfig = cfg
+		default:
+			panic("option network tls config unknown type")
+		}
+	}
+}
+
+// TcpReconnect keeps client links alive: a failed dial or a dropped link is retried
+// with exponential backoff between minDelay and maxDelay. maxAttempts 0 retries forever.
+// minDelay is raised to TCP_RECONNECT_MIN_DELAY, so a dead endpoint is never redialed
+// in a tight loop.
+func TcpReconnect(minDelay time.Duration, maxDelay time.Duration, maxAttempts int) Option {
+	return func(args ...interface{}) {
+		t := args[0]
+		switch v := t.(type) {
+		case *TcpClientMgr:
+			if minDelay < TCP_RECONNECT_MIN_DELAY {
+				minDelay = TCP_RECONNECT_MIN_DELAY
+			}
+			if maxDelay < minDelay {
+				maxDelay = minDelay
+			}
+			v.reconnect = &reconnectOption{
+				minDelay:    minDelay,
+				maxDelay:    maxDelay,
+				maxAttempts: maxAttempts,
+			}
+		default:
+			panic("option network reconnect unknown type")
+		}
+	}
+}
+
+// TcpMaxConn limits the connections a server serves at once, in total and per remote
+// ip, 0 is unlimited. Connections over a limit are closed right after accept.
+func TcpMaxConn(maxConns int, maxPerIP int) Option {
+	return func(args ...interface{}) {
+		t := args[0]
+		switch v := t.(type) {
+		case *TcpServerMgr:
+			v.filter.maxConns = maxConns
+			v.filter.maxPerIP = maxPerIP
+		default:
+			panic("option network max conn unknown type")
+		}
+	}
+}
+
+// TcpAcceptRate limits the connections a server accepts per second, 0 is unlimited.
+func TcpAcceptRate(perSecond int) Option {
+	return func(args ...interface{}) {
+		t := args[0]
+		switch v := t.(type) {
+		case *TcpServerMgr:
+			v.filter.rate = perSecond
+			v.filter.tokens = int64(perSecond) * 1000
+			v.filter.rateTick = UnixTS()
+		default:
+			panic("option network accept rate unknown type")
+		}
+	}
+}
+
+// TcpIPFilter sets the CIDR allow and deny lists of a server, see SetIPFilter.
+func TcpIPFilter(allow []string, deny []string) Option {
+	return func(args ...interface{}) {
+		t := args[0]
+		switch v := t.(type) {
+		case *TcpServerMgr:
+			if err := v.SetIPFilter(allow, deny); err != nil {
+				panic("option network ip filter " + err.Error())
+			}
+		default:
+			panic("option network ip filter unknown type")
+		}
+	}
+}
+
+// TcpProxyProtocol makes a server read a PROXY protocol v1 or v2 header first on
+// every connection, and report the client address it carries as the remote address.
+// Connections without a valid header are closed. Any client can claim any address
+// this way, so a server also reachable directly should set TcpProxyTrusted.
+func TcpProxyProtocol(e bool) Option {
+	return func(args ...interface{}) {
+		t := args[0]
+		switch v := t.(type) {
+		case *TcpServerMgr:
+			v.proxyProto = e
+		default:
+			panic("option network proxy protocol unknown type")
+		}
+	}
+}
+
+// TcpProxyTrusted turns on TcpProxyProtocol for connections from the given proxy
+// CIDR blocks only; other connections are served with their own address and no
+// header is read from them.
+func TcpProxyTrusted(trusted []string) Option {
+	return func(args ...interface{}) {
+		t := args[0]
+		switch v := t.(type) {
+		case *TcpServerMgr:
+			nets, err := parseCIDRs(trusted)
+			if err != nil {
+				panic("option network proxy trusted " + err.Error())
+			}
+			v.proxyProto = true
+			v.proxyTrusted = nets
+		default:
+			panic("option network proxy trusted unknown type")
+		}
+	}
+}
+
+func WsPath(path string) Option {
+	return func(args ...interface{}) {
+		t := args[0]
+		switch v := t.(type) {
+		case *WsServerMgr:
+			v.path = path
+		default:
+			panic("option network ws path unknown type")
+		}
+	}
+}
+
+func WsCheckOrigin(f func(*http.Request) bool) Option {
+	return func(args ...interface{}) {
+		t := args[0]
+		switch v := t.(type) {
+		case *WsServerMgr:
+			v.checkOrigin = f
+		default:
+			panic("option network ws check origin unknown type")
+		}
+	}
+}
+
+// TransportMaxCount enables the inbound msg rate limit of c msgs per second, which
+// is off by default. See TransportRateLimit for what happens to msgs over it.
 func TransportMaxCount(c int) Option {
 	return func(args ...interface{}) {
 		if t, ok := args[0].(OptionMgr); ok == true {
 			t.GetOption().msg_max_count = int32(c)
 		} else {
-			panic("option network transport keep alive unknown type")
+			panic("option network transport max count unknown type")
 		}
 	}
 }
@@ -97,7 +304,6 @@ func TransportMaxLength(c int) Option {
 	}
 }
 
-
 func TransportKeepAlive(e bool, c int64) Option {
 	return func(args ...interface{}) {
 		if t, ok := args[0].(OptionMgr); ok == true {
@@ -108,3 +314,160 @@ func TransportKeepAlive(e bool, c int64) Option {
 		}
 	}
 }
+
+func TransportCodec(r *CodecRegistry) Option {
+	return func(args ...interface{}) {
+		if t, ok := args[0].(OptionMgr); ok == true {
+			t.GetOption().codec = r
+		} else {
+			panic("option network transport codec unknown type")
+		}
+	}
+}
+
+// TransportWireVersion sets the packet framing version a link writes, v1 by default.
+// With compat enabled an incoming link writes v1 until the peer sends v2, so old v1
+// clients never see a v2 packet, and an outgoing link accepts v1 packets.
+func TransportWireVersion(v int, compat bool) Option {
+	return func(args ...interface{}) {
+		if t, ok := args[0].(OptionMgr); ok == true {
+			if v != MSG_VERSION_1 && v != MSG_VERSION_2 {
+				panic("option network transport wire version unknown")
+			}
+			t.GetOption().wire_version = int32(v)
+			t.GetOption().wire_compat = compat
+		} else {
+			panic("option network transport wire version unknown type")
+		}
+	}
+}
+
+// TransportCompress deflates packet bodies of at least threshold bytes, 0 disables it.
+// Compressed packets are always accepted on read, whatever the local setting.
+func TransportCompress(threshold int) Option {
+	return func(args ...interface{}) {
+		if t, ok := args[0].(OptionMgr); ok == true {
+			t.GetOption().compress_threshold = threshold
+		} else {
+			panic("option network transport compress unknown type")
+		}
+	}
+}
+
+// TransportEncrypt enables the X25519 key exchange and AES-GCM packet encryption.
+// Both ends of a link must enable it. It can not be combined with TransportPacketCodec.
+func TransportEncrypt(e bool) Option {
+	return func(args ...interface{}) {
+		if t, ok := args[0].(OptionMgr); ok == true {
+			if e == true && t.GetOption().packet_codec != nil {
+				panic("option network transport encrypt with packet codec")
+			}
+			t.GetOption().encrypt = e
+		} else {
+			panic("option network transport encrypt unknown type")
+		}
+	}
+}
+
+// TransportFragment lets messages longer than the packet limit be split into
+// fragments, reassembled up to maxTotal bytes on receive, 0 disables it.
+func TransportFragment(maxTotal uint32) Option {
+	return func(args ...interface{}) {
+		if t, ok := args[0].(OptionMgr); ok == true {
+			t.GetOption().msg_max_total = maxTotal
+		} else {
+			panic("option network transport fragment unknown type")
+		}
+	}
+}
+
+// TransportRateLimit sets what a linker does with inbound msgs over the rate set by
+// TransportMaxCount: RATE_LIMIT_DROP, RATE_LIMIT_DELAY or RATE_LIMIT_CLOSE.
+func TransportRateLimit(action int) Option {
+	return func(args ...interface{}) {
+		if t, ok := args[0].(OptionMgr); ok == true {
+			if action < RATE_LIMIT_DROP || action > RATE_LIMIT_CLOSE {
+				panic("option network transport rate limit action unknown")
+			}
+			t.GetOption().rate_limit_action = action
+		} else {
+			panic("option network transport rate limit unknown type")
+		}
+	}
+}
+
+// TransportWriteLimit bounds the msgs and bytes queued for writing on a linker, 0 is
+// unlimited. policy is WRITE_DROP_NEWEST, WRITE_DROP_OLDEST or WRITE_CLOSE_LINK;
+// rpc answers always go out and queued rpc requests are never dropped.
+func TransportWriteLimit(maxCount int, maxBytes int, policy int) Option {
+	return func(args ...interface{}) {
+		if t, ok := args[0].(OptionMgr); ok == true {
+			if policy < WRITE_DROP_NEWEST || policy > WRITE_CLOSE_LINK {
+				panic("option network transport write policy unknown")
+			}
+			t.GetOption().write_max_count = maxCount
+			t.GetOption().write_max_bytes = maxBytes
+			t.GetOption().write_policy = policy
+		} else {
+			panic("option network transport write limit unknown type")
+		}
+	}
+}
+
+// TransportFlush sets how many packed bytes force a flush of the write buffer and
+// how long the writer may wait for more msgs before flushing a smaller batch.
+func TransportFlush(maxSize int, delay time.Duration) Option {
+	return func(args ...interface{}) {
+		if t, ok := args[0].(OptionMgr); ok == true {
+			if maxSize <= 0 {
+				maxSize = MSG_DEFAULT_FLUSH_SIZE
+			}
+			t.GetOption().write_flush_size = maxSize
+			t.GetOption().write_flush_delay = delay
+		} else {
+			panic("option network transport flush unknown type")
+		}
+	}
+}
+
+// TransportLinger makes CloseWithReason wait up to linger for pending writes and for
+// the peer to close, and send a 'C' close frame with the reason first when closeFrame
+// is set. Both are off by default: peers older than the close frame do not know it.
+func TransportLinger(linger time.Duration, closeFrame bool) Option {
+	return func(args ...interface{}) {
+		if t, ok := args[0].(OptionMgr); ok == true {
+			t.GetOption().linger = linger
+			t.GetOption().close_frame = closeFrame
+		} else {
+			panic("option network transport linger unknown type")
+		}
+	}
+}
+
+// TransportBatch limits the msg bytes one MultipleMsg batch may hold, 0 is unlimited.
+// WriteMsg and RpcCall on a full batch return false and leave it unchanged.
+func TransportBatch(maxSize int) Option {
+	return func(args ...interface{}) {
+		if t, ok := args[0].(OptionMgr); ok == true {
+			t.GetOption().batch_max_size = maxSize
+		} else {
+			panic("option network transport batch unknown type")
+		}
+	}
+}
+
+// TransportPacketCodec frames packets with a PacketCodec from f, called once per
+// linker, instead of the einx framing. nil restores the einx framing. The einx
+// packet encryption does not apply to codec links, use TLS instead.
+func TransportPacketCodec(f func() PacketCodec) Option {
+	return func(args ...interface{}) {
+		if t, ok := args[0].(OptionMgr); ok == true {
+			if f != nil && t.GetOption().encrypt == true {
+				panic("option network transport packet codec with encrypt")
+			}
+			t.GetOption().packet_codec = f
+		} else {
+			panic("option network transport packet codec unknown type")
+		}
+	}
+}
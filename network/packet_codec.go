@@ -0,0 +1,234 @@
+package network
+
+import (
+	"errors"
+	"github.com/Cyinx/einx/slog"
+	"io"
+)
+
+var (
+	PACKET_CODEC_TYPE_ERR = errors.New("packet codec frame type unknown.")
+)
+
+// PacketFrame is one packet as seen by a PacketCodec. Type is 'P' (msg), 'R' (rpc
+// request), 'A' (rpc answer, SeqID set), 'T' (ping, no body) or 'C' (close, MsgID is
+// the close code and Body the reason).
+type PacketFrame struct {
+	Type  byte
+	MsgID ProtoTypeID
+	SeqID uint32
+	Body  []byte
+}
+
+// PacketCodec replaces the einx packet framing of a linker, so that foreign client
+// protocols are served through the usual SessionHandler. A codec serves a single
+// linker: ReadFrame is called from its read loop only, WriteFrame and PingFrame
+// from its write loop only. Compression, encryption and fragmentation are done by
+// the native einx framing only; EinxPacketCodec is its plain form, for codecs that
+// wrap or extend it.
+type PacketCodec interface {
+	// ReadFrame reads the next packet from r into f. f.Body may point into memory
+	// owned by the codec, it is only used until ReadFrame returns again.
+	ReadFrame(r io.Reader, f *PacketFrame) error
+	// WriteFrame appends the encoded packet f to b. A protocol without close
+	// frames returns b as is for 'C'.
+	WriteFrame(b []byte, f *PacketFrame) ([]byte, error)
+	// PingFrame appends a keep alive packet to b, or returns b as is when the
+	// protocol has none.
+	PingFrame(b []byte) []byte
+}
+
+// readCodecPacket is ReadMsgPacket for linkers with a PacketCodec. The body is
+// copied into a pooled buffer handed over to readMsg.
+func (n *tcpTransport) readCodecPacket(reader io.Reader) (ProtoTypeID, []byte, error) {
+	f := &n.codecFrame
+	f.Type, f.MsgID, f.SeqID, f.Body = 0, 0, 0, nil
+	if err := n.packetCodec.ReadFrame(reader, f); err != nil {
+		return 0, nil, err
+	}
+
+	msgPacket := &n.msgPacket
+	msgPacket.MsgType = f.Type
+	msgPacket.PacketFlag = 0
+	msgPacket.BodyLength = uint32(len(f.Body))
+	msgPacket.RpcSeqID = f.SeqID
+
+	switch f.Type {
+	case 'T':
+		return 0, nil, nil
+	case 'C':
+		reason := f.Body
+		if len(reason) > MSG_CLOSE_REASON_MAX {
+			reason = reason[:MSG_CLOSE_REASON_MAX]
+		}
+		b := make([]byte, MSG_CLOSE_CODE_LENGTH+len(reason))
+		bigEndian.PutUint16(b, uint16(f.MsgID))
+		copy(b[MSG_CLOSE_CODE_LENGTH:], reason)
+		return 0, b, nil
+	case 'P', 'R', 'A':
+	default:
+		return 0, nil, PACKET_CODEC_TYPE_ERR
+	}
+
+	if msgPacket.BodyLength >= n.option.msg_max_length {
+		return 0, nil, MSG_TOO_LONG_ERR
+	}
+
+	pkt := getBuffer(len(f.Body))
+	msgBody := pkt.WriteBuf()[:len(f.Body)]
+	pkt.WriteBytes(f.Body)
+	n.readMsg = newMsgBuffer(pkt, msgBody)
+	return f.MsgID, msgBody, nil
+}
+
+func (n *tcpTransport) packCodecMsg(msg ITransportMsg) {
+	b := n.codecBuf[:0]
+	var err error
+	switch m := msg.(type) {
+	case *TransportMsgPack:
+		if m.msgType == 'T' {
+			b = n.packetCodec.PingFrame(b)
+			break
+		}
+		b, err = n.packetCodec.WriteFrame(b, &PacketFrame{Type: m.msgType, MsgID: m.msgID, SeqID: m.seqID, Body: m.Buf})
+	case *groupFrame:
+		b, err = n.packetCodec.WriteFrame(b, &PacketFrame{Type: 'P', MsgID: m.msgID, Body: m.body})
+	case *TransportMultiple:
+		for _, v := range m.msgArray {
+			n.packCodecMsg(v)
+		}
+		return
+	}
+
+	n.codecBuf = b
+	if err != nil {
+		slog.LogError("tcp_transport", "linker [%v] packet codec write error: %v, dropped", n.agentID, err)
+		return
+	}
+	buf := n.writeBuf
+	buf.Reserve(len(b))
+	buf.WriteBytes(b)
+}
+
+// EinxPacketCodec is the einx packet framing without packet flags. It writes
+// Version packets, reads both versions and refuses bodies of MaxLength bytes or more.
+type EinxPacketCodec struct {
+	Version   int
+	MaxLength uint32
+	header    [MSG_HEADER_LENGTH_V2]byte
+	body      []byte
+}
+
+// NewEinxPacketCodec returns the einx framing as a PacketCodec, for TransportPacketCodec.
+func NewEinxPacketCodec(version int, maxLength uint32) PacketCodec {
+	if maxLength == 0 {
+		maxLength = MSG_MAX_BODY_LENGTH
+	}
+	return &EinxPacketCodec{Version: version, MaxLength: maxLength}
+}
+
+func (c *EinxPacketCodec) ReadFrame(r io.Reader, f *PacketFrame) error {
+	header := c.header[:]
+	if _, err := io.ReadFull(r, header[:1]); err != nil {
+		return err
+	}
+
+	var msgType, flag byte
+	var bodyLength int
+	if header[0] == MSG_MAGIC_V2 {
+		if _, err := io.ReadFull(r, header[1:MSG_HEADER_LENGTH_V2]); err != nil {
+			return err
+		}
+		msgType, flag = header[1], header[2]
+		bodyLength = int(bigEndian.Uint32(header[3:]))
+	} else {
+		if _, err := io.ReadFull(r, header[1:MSG_HEADER_LENGTH]); err != nil {
+			return err
+		}
+		msgType, flag = header[0], header[3]
+		bodyLength = int(bigEndian.Uint16(header[1:]))
+	}
+
+	if flag != 0 {
+		return errors.New("msg packet flag not supported.")
+	}
+	if uint32(bodyLength) >= c.MaxLength {
+		return MSG_TOO_LONG_ERR
+	}
+
+	if cap(c.body) < bodyLength {
+		c.body = make([]byte, bodyLength)
+	}
+	body := c.body[:bodyLength]
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+
+	f.Type = msgType
+	switch msgType {
+	case 'T':
+		return nil
+	case 'C':
+		if bodyLength < MSG_CLOSE_CODE_LENGTH {
+			return errors.New("msg packet close frame error.")
+		}
+		f.MsgID = ProtoTypeID(bigEndian.Uint16(body))
+		f.Body = body[MSG_CLOSE_CODE_LENGTH:]
+		return nil
+	}
+
+	if bodyLength < MSG_ID_LENGTH {
+		return errors.New("msg packet length error")
+	}
+	f.MsgID = bigEndian.Uint32(body)
+	body = body[MSG_ID_LENGTH:]
+	if isRpcMsgType(msgType) == true {
+		if len(body) < MSG_SEQ_LENGTH {
+			return errors.New("rpc msg packet length error")
+		}
+		f.SeqID = bigEndian.Uint32(body)
+		body = body[MSG_SEQ_LENGTH:]
+	}
+	f.Body = body
+	return nil
+}
+
+func (c *EinxPacketCodec) WriteFrame(b []byte, f *PacketFrame) ([]byte, error) {
+	bodyLength := len(f.Body)
+	switch {
+	case f.Type == 'C':
+		bodyLength += MSG_CLOSE_CODE_LENGTH
+	case isRpcMsgType(f.Type) == true:
+		bodyLength += MSG_ID_LENGTH + MSG_SEQ_LENGTH
+	default:
+		bodyLength += MSG_ID_LENGTH
+	}
+	if c.Version == MSG_VERSION_1 && bodyLength > MSG_MAX_BODY_LENGTH_V1 {
+		return b, MSG_TOO_LONG_ERR
+	}
+
+	b = c.appendHeader(b, f.Type, bodyLength)
+	if f.Type == 'C' {
+		b = bigEndian.AppendUint16(b, uint16(f.MsgID))
+		return append(b, f.Body...), nil
+	}
+	b = bigEndian.AppendUint32(b, f.MsgID)
+	if isRpcMsgType(f.Type) == true {
+		b = bigEndian.AppendUint32(b, f.SeqID)
+	}
+	return append(b, f.Body...), nil
+}
+
+func (c *EinxPacketCodec) PingFrame(b []byte) []byte {
+	return c.appendHeader(b, 'T', 0)
+}
+
+func (c *EinxPacketCodec) appendHeader(b []byte, msgType byte, bodyLength int) []byte {
+	if c.Version == MSG_VERSION_1 {
+		b = append(b, msgType)
+		b = bigEndian.AppendUint16(b, uint16(bodyLength))
+		return append(b, 0)
+	}
+	b = append(b, MSG_MAGIC_V2, msgType, 0)
+	return bigEndian.AppendUint32(b, uint32(bodyLength))
+}
@@ -0,0 +1,172 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PROXY_HEADER_TIMEOUT   = 5 * time.Second
+	PROXY_PREFIX_LENGTH    = 5
+	PROXY_V1_MAX_LENGTH    = 107
+	PROXY_V2_HEADER_LENGTH = 16
+)
+
+var (
+	PROXY_HEADER_ERR      = errors.New("proxy protocol header error.")
+	PROXY_CLOSE_WRITE_ERR = errors.New("proxy protocol conn can not close write.")
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is an accepted connection whose PROXY protocol header has been read.
+// RemoteAddr reports the client address carried by the header.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.reader != nil {
+		if c.reader.Buffered() > 0 {
+			return c.reader.Read(b)
+		}
+		c.reader = nil
+	}
+	return c.Conn.Read(b)
+}
+
+// CloseWrite half closes the proxied connection for a lingering close.
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok == true {
+		return cw.CloseWrite()
+	}
+	return PROXY_CLOSE_WRITE_ERR
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header off rawConn. Links the
+// header marks as local or unknown keep the address of the proxy itself.
+func readProxyHeader(rawConn net.Conn) (net.Conn, error) {
+	_ = rawConn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT))
+	reader := bufio.NewReader(rawConn)
+
+	// the shortest header, "PROXY UNKNOWN\r\n", is 15 bytes: only the prefix is peeked
+	prefix, err := reader.Peek(PROXY_PREFIX_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	var addr net.Addr
+	if bytes.Equal(prefix, proxyV2Signature[:PROXY_PREFIX_LENGTH]) == true {
+		addr, err = readProxyV2(reader)
+	} else if bytes.Equal(prefix, []byte("PROXY")) == true {
+		addr, err = readProxyV1(reader)
+	} else {
+		err = PROXY_HEADER_ERR
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_ = rawConn.SetReadDeadline(time.Time{})
+	if addr == nil {
+		addr = rawConn.RemoteAddr()
+	}
+	return &proxyConn{Conn: rawConn, reader: reader, remote: addr}, nil
+}
+
+// readProxyV1 parses "PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n".
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if err != nil || len(line) > PROXY_V1_MAX_LENGTH || bytes.HasSuffix(line, []byte("\r\n")) == false {
+		return nil, PROXY_HEADER_ERR
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" {
+		return nil, PROXY_HEADER_ERR
+	}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, PROXY_HEADER_ERR
+	}
+
+	src, ok := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	if ok == false {
+		return nil, PROXY_HEADER_ERR
+	}
+	if _, ok := parseProxyV1Addr(fields[1], fields[3], fields[5]); ok == false {
+		return nil, PROXY_HEADER_ERR
+	}
+	return src, nil
+}
+
+// parseProxyV1Addr parses an address of family "TCP4" or "TCP6". The family is
+// that of the text form, so a TCP6 line may carry an ipv4 mapped address.
+func parseProxyV1Addr(family string, host string, port string) (*net.TCPAddr, bool) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil || (family == "TCP6") != strings.Contains(host, ":") {
+		return nil, false
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, true
+}
+
+// readProxyV2 parses the binary header: signature, version and command, address
+// family, address length and the addresses, followed by TLVs which are skipped.
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	var header [PROXY_V2_HEADER_LENGTH]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(header[:len(proxyV2Signature)], proxyV2Signature) == false {
+		return nil, PROXY_HEADER_ERR
+	}
+
+	verCmd := header[12]
+	family := header[13]
+	length := int(bigEndian.Uint16(header[14:]))
+	if verCmd>>4 != 2 || verCmd&0x0f > 1 {
+		return nil, PROXY_HEADER_ERR
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	if verCmd&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch family {
+	case 0x11:
+		if length < 12 {
+			return nil, PROXY_HEADER_ERR
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(bigEndian.Uint16(body[8:]))}, nil
+	case 0x21:
+		if length < 36 {
+			return nil, PROXY_HEADER_ERR
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(bigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
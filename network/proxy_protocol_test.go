@@ -0,0 +1,92 @@
+package network
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func proxyV2Header(verCmd byte, family byte, body []byte) []byte {
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, verCmd, family, byte(len(body)>>8), byte(len(body)))
+	return append(b, body...)
+}
+
+var proxyHeaderTests = []struct {
+	name   string
+	header []byte
+	remote string // "" means the address of the proxy itself
+	ok     bool
+}{
+	{"v1 tcp4", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 4000 80\r\n"), "1.2.3.4:4000", true},
+	{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4000 80\r\n"), "[2001:db8::1]:4000", true},
+	{"v1 tcp6 mapped", []byte("PROXY TCP6 ::ffff:1.2.3.4 ::ffff:5.6.7.8 4000 80\r\n"), "1.2.3.4:4000", true},
+	{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", true},
+	{"v1 unknown addresses", []byte("PROXY UNKNOWN 1.2.3.4 5.6.7.8 4000 80\r\n"), "", true},
+	{"v1 tcp4 with ipv6", []byte("PROXY TCP4 2001:db8::1 5.6.7.8 4000 80\r\n"), "", false},
+	{"v1 tcp6 with ipv4", []byte("PROXY TCP6 1.2.3.4 2001:db8::2 4000 80\r\n"), "", false},
+	{"v1 tcp4 bad destination", []byte("PROXY TCP4 1.2.3.4 2001:db8::2 4000 80\r\n"), "", false},
+	{"v1 bad ip", []byte("PROXY TCP4 1.2.3 5.6.7.8 4000 80\r\n"), "", false},
+	{"v1 bad port", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 70000 80\r\n"), "", false},
+	{"v1 missing field", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 4000\r\n"), "", false},
+	{"v1 bad family", []byte("PROXY UDP4 1.2.3.4 5.6.7.8 4000 80\r\n"), "", false},
+	{"v1 bad keyword", []byte("PROXYX TCP4 1.2.3.4 5.6.7.8 4000 80\r\n"), "", false},
+	{"v1 no crlf", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 4000 80\n"), "", false},
+	{"v1 truncated", []byte("PROXY TCP4 1.2.3.4"), "", false},
+	{"v1 too long", append([]byte("PROXY TCP4 "), make([]byte, PROXY_V1_MAX_LENGTH)...), "", false},
+	{"v2 tcp4", proxyV2Header(0x21, 0x11, []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x0f, 0xa0, 0, 80}), "1.2.3.4:4000", true},
+	{"v2 tcp6", proxyV2Header(0x21, 0x21, append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0x0f, 0xa0, 0, 80)), "[2001:db8::1]:4000", true},
+	{"v2 tcp4 with tlvs", proxyV2Header(0x21, 0x11, []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x0f, 0xa0, 0, 80, 0x04, 0, 1, 0}), "1.2.3.4:4000", true},
+	{"v2 local", proxyV2Header(0x20, 0x00, nil), "", true},
+	{"v2 unspec", proxyV2Header(0x21, 0x00, nil), "", true},
+	{"v2 tcp4 short", proxyV2Header(0x21, 0x11, []byte{1, 2, 3, 4, 5, 6, 7, 8}), "", false},
+	{"v2 tcp6 short", proxyV2Header(0x21, 0x21, make([]byte, 12)), "", false},
+	{"v2 bad version", proxyV2Header(0x11, 0x11, make([]byte, 12)), "", false},
+	{"v2 bad command", proxyV2Header(0x22, 0x11, make([]byte, 12)), "", false},
+	{"v2 bad signature", append([]byte("\r\n\r\n\x00\r\nQUITX"), 0x21, 0x11, 0, 0), "", false},
+	{"v2 truncated header", proxyV2Signature[:8], "", false},
+	{"v2 truncated body", proxyV2Header(0x21, 0x11, []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x0f, 0xa0, 0, 80})[:20], "", false},
+	{"no header", []byte("\x50\x00\x08\x00\x00\x00\x00\x01xxxx"), "", false},
+	{"empty", nil, "", false},
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, tt := range proxyHeaderTests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			go func() {
+				_, _ = client.Write(tt.header)
+				if tt.ok == true {
+					_, _ = client.Write([]byte("data"))
+				}
+				_ = client.Close()
+			}()
+
+			conn, err := readProxyHeader(server)
+			if tt.ok == false {
+				if err == nil {
+					t.Fatalf("header accepted, remote %v", conn.RemoteAddr())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			remote := tt.remote
+			if remote == "" {
+				remote = server.RemoteAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != remote {
+				t.Fatalf("remote %s, want %s", got, remote)
+			}
+
+			data, err := io.ReadAll(conn)
+			if err != nil || string(data) != "data" {
+				t.Fatalf("data after header %q, %v", data, err)
+			}
+		})
+	}
+}
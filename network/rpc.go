@@ -22,7 +22,12 @@ func RpcMarshal(b []byte, val interface{}) []byte {
 		buffer = append(b, 's', byte(slen), byte(slen>>8), byte(slen>>16), byte(slen>>24))
 		buffer = append(buffer, v...)
 	case float32, float64:
-		n := math.Float64bits(v.(float64))
+		var n uint64
+		if f, ok := v.(float32); ok == true {
+			n = math.Float64bits(float64(f))
+		} else {
+			n = math.Float64bits(v.(float64))
+		}
 		buffer = append(b, 'd', '2', byte(n), byte(n>>8), byte(n>>16), byte(n>>24), byte(n>>32), byte(n>>40), byte(n>>48), byte(n>>56))
 	case int, int16, uint16, int32, int64, uint32, uint64:
 		I64i, Itype := convertInteger(v)
@@ -193,5 +198,4 @@ func RpcUnMarshal(b []byte) (interface{}, []byte) {
 		slog.LogError("rpc_unmarshal", "error rpc type %v", t)
 		panic("error rpc type")
 	}
-	return nil, b
 }
@@ -0,0 +1,316 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"github.com/Cyinx/einx/event"
+	"github.com/Cyinx/einx/slog"
+	"sync"
+)
+
+var (
+	RPC_CALL_TIMEOUT_ERR = errors.New("rpc call timeout.")
+	RPC_LINK_CLOSED_ERR  = errors.New("rpc call link closed.")
+)
+
+type RpcCallback func(ProtoTypeID, []byte, error)
+
+type RpcRequestHandler interface {
+	ServeRpcRequest(Agent, ProtoTypeID, uint32, []byte)
+}
+
+type rpcTimerOwner interface {
+	AddTimer(delay uint64, op TimerHandler, args ...interface{}) uint64
+	RemoveTimer(timer_id uint64) bool
+}
+
+type rpcPendingCall struct {
+	seqID   uint32
+	msgID   ProtoTypeID
+	timerID uint64
+	direct  bool
+	cb      RpcCallback
+}
+
+type rpcReplyEventMsg struct {
+	sender Agent
+	call   *rpcPendingCall
+	msgID  ProtoTypeID
+	data   []byte
+	err    error
+	timer  rpcTimerOwner
+}
+
+func (e *rpcReplyEventMsg) GetType() event.EventType {
+	return event.EVENT_COMPONENT_CUSTOM
+}
+
+func (e *rpcReplyEventMsg) GetSender() Agent {
+	return e.sender
+}
+
+func (e *rpcReplyEventMsg) GetAction() func(event.CustomActionEventMsg) {
+	return doRpcReply
+}
+
+func (e *rpcReplyEventMsg) Reset() {
+	e.sender = nil
+	e.call = nil
+	e.data = nil
+	e.err = nil
+	e.timer = nil
+}
+
+func doRpcReply(msg event.CustomActionEventMsg) {
+	e := msg.(*rpcReplyEventMsg)
+	call := e.call
+	if call.timerID != 0 && e.timer != nil {
+		e.timer.RemoveTimer(call.timerID)
+	}
+	call.cb(e.msgID, e.data, e.err)
+	e.Reset()
+}
+
+type rpcCallMgr struct {
+	lock    sync.Mutex
+	seqID   uint32
+	closed  bool
+	pending map[uint32]*rpcPendingCall
+}
+
+func newRpcCallMgr() *rpcCallMgr {
+	return &rpcCallMgr{
+		pending: make(map[uint32]*rpcPendingCall),
+	}
+}
+
+func (r *rpcCallMgr) add(msgID ProtoTypeID, direct bool, cb RpcCallback) *rpcPendingCall {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed == true {
+		return nil
+	}
+	r.seqID++
+	if r.seqID == 0 {
+		r.seqID = 1
+	}
+	call := &rpcPendingCall{
+		seqID:  r.seqID,
+		msgID:  msgID,
+		direct: direct,
+		cb:     cb,
+	}
+	r.pending[call.seqID] = call
+	return call
+}
+
+func (r *rpcCallMgr) remove(seqID uint32) *rpcPendingCall {
+	r.lock.Lock()
+	call, ok := r.pending[seqID]
+	if ok == true {
+		delete(r.pending, seqID)
+	}
+	r.lock.Unlock()
+	return call
+}
+
+func (r *rpcCallMgr) close() []*rpcPendingCall {
+	r.lock.Lock()
+	r.closed = true
+	calls := make([]*rpcPendingCall, 0, len(r.pending))
+	for seqID, call := range r.pending {
+		calls = append(calls, call)
+		delete(r.pending, seqID)
+	}
+	r.lock.Unlock()
+	return calls
+}
+
+// RpcRequest sends an 'R' packet tagged with a sequence id and calls cb on the
+// owning module's event loop once the peer answers, the timeout (milliseconds,
+// 0 means none) fires or the link closes. It must be called from the module
+// that owns this linker.
+func (n *TcpConn) RpcRequest(msgID ProtoTypeID, b []byte, timeout uint64, cb RpcCallback) bool {
+	if n.IsClosed() == true || cb == nil {
+		return false
+	}
+
+	call := n.rpcCalls.add(msgID, false, cb)
+	if call == nil {
+		return false
+	}
+
+	if timeout > 0 {
+		if t, ok := n.module.(rpcTimerOwner); ok == true {
+			call.timerID = t.AddTimer(timeout, n.onRpcTimeout, call.seqID)
+		} else {
+			slog.LogWarning("tcp_rpc", "module of linker [%v] has no timer, rpc timeout ignored", n.agentID)
+		}
+	}
+
+	w := writePool.Get().(*TransportMsgPack)
+	w.msgType = 'R'
+	w.msgID = msgID
+	w.seqID = call.seqID
+	w.Buf = b
+
+	if n.doPushWrite(w) == false {
+		if n.rpcCalls.remove(call.seqID) != nil && call.timerID != 0 {
+			n.module.(rpcTimerOwner).RemoveTimer(call.timerID)
+		}
+		return false
+	}
+	return true
+}
+
+type rpcStartEventMsg struct {
+	linker  *TcpConn
+	msgID   ProtoTypeID
+	data    []byte
+	timeout uint64
+	cb      RpcCallback
+}
+
+func (e *rpcStartEventMsg) GetType() event.EventType {
+	return event.EVENT_COMPONENT_CUSTOM
+}
+
+func (e *rpcStartEventMsg) GetSender() Agent {
+	return e.linker
+}
+
+func (e *rpcStartEventMsg) GetAction() func(event.CustomActionEventMsg) {
+	return doRpcStart
+}
+
+func (e *rpcStartEventMsg) Reset() {
+	e.linker = nil
+	e.data = nil
+	e.cb = nil
+}
+
+func doRpcStart(msg event.CustomActionEventMsg) {
+	e := msg.(*rpcStartEventMsg)
+	if e.linker.RpcRequest(e.msgID, e.data, e.timeout, e.cb) == false {
+		e.cb(e.msgID, nil, RPC_LINK_CLOSED_ERR)
+	}
+	e.Reset()
+}
+
+// PostRpcRequest is RpcRequest for callers outside the module that owns this
+// linker: the request is started on the owner's event loop, where cb runs too.
+// A request that can not be sent gets RPC_LINK_CLOSED_ERR through cb.
+func (n *TcpConn) PostRpcRequest(msgID ProtoTypeID, b []byte, timeout uint64, cb RpcCallback) bool {
+	if n.IsClosed() == true || cb == nil || n.module == nil {
+		return false
+	}
+	n.module.PushEventMsg(&rpcStartEventMsg{
+		linker:  n,
+		msgID:   msgID,
+		data:    b,
+		timeout: timeout,
+		cb:      cb,
+	})
+	return true
+}
+
+type rpcAwaitResult struct {
+	data []byte
+	err  error
+}
+
+// AwaitRpcRequest is the blocking form of RpcRequest, bounded by ctx. The answer is
+// handed over straight from the read goroutine, so it is safe to call from any goroutine.
+func (n *TcpConn) AwaitRpcRequest(ctx context.Context, msgID ProtoTypeID, b []byte) ([]byte, error) {
+	if n.IsClosed() == true {
+		return nil, RPC_LINK_CLOSED_ERR
+	}
+
+	await := make(chan rpcAwaitResult, 1)
+	call := n.rpcCalls.add(msgID, true, func(_ ProtoTypeID, data []byte, err error) {
+		await <- rpcAwaitResult{data: data, err: err}
+	})
+	if call == nil {
+		return nil, RPC_LINK_CLOSED_ERR
+	}
+
+	w := writePool.Get().(*TransportMsgPack)
+	w.msgType = 'R'
+	w.msgID = msgID
+	w.seqID = call.seqID
+	w.Buf = b
+	if n.doPushWrite(w) == false {
+		n.rpcCalls.remove(call.seqID)
+		return nil, WRITE_QUEUE_FULL_ERR
+	}
+
+	select {
+	case r := <-await:
+		return r.data, r.err
+	case <-ctx.Done():
+		if n.rpcCalls.remove(call.seqID) == nil {
+			r := <-await
+			return r.data, r.err
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, RPC_CALL_TIMEOUT_ERR
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (n *TcpConn) RpcReply(seqID uint32, msgID ProtoTypeID, b []byte) bool {
+	if n.IsClosed() == true || seqID == 0 {
+		return false
+	}
+
+	w := writePool.Get().(*TransportMsgPack)
+	w.msgType = 'A'
+	w.msgID = msgID
+	w.seqID = seqID
+	w.Buf = b
+
+	return n.doPushWrite(w)
+}
+
+func (n *TcpConn) onRpcTimeout(args []interface{}) {
+	seqID := args[0].(uint32)
+	if call := n.rpcCalls.remove(seqID); call != nil {
+		call.cb(call.msgID, nil, RPC_CALL_TIMEOUT_ERR)
+	}
+}
+
+func (n *TcpConn) onRpcReply(msgID ProtoTypeID, seqID uint32, b []byte) {
+	call := n.rpcCalls.remove(seqID)
+	if call == nil {
+		return
+	}
+	data := make([]byte, len(b))
+	copy(data, b)
+	n.postRpcReply(call, msgID, data, nil)
+}
+
+func (n *TcpConn) failRpcCalls() {
+	for _, call := range n.rpcCalls.close() {
+		n.postRpcReply(call, call.msgID, nil, RPC_LINK_CLOSED_ERR)
+	}
+}
+
+func (n *TcpConn) postRpcReply(call *rpcPendingCall, msgID ProtoTypeID, data []byte, err error) {
+	if call.direct == true {
+		call.cb(msgID, data, err)
+		return
+	}
+	if n.module == nil {
+		return
+	}
+	e := &rpcReplyEventMsg{
+		sender: n,
+		call:   call,
+		msgID:  msgID,
+		data:   data,
+		err:    err,
+	}
+	e.timer, _ = n.module.(rpcTimerOwner)
+	n.module.PushEventMsg(e)
+}
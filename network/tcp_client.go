@@ -1,26 +1,60 @@
 package network
 
 import (
+	"crypto/tls"
 	"github.com/Cyinx/einx/event"
 	"github.com/Cyinx/einx/slog"
+	"math/rand"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
+// TCP_LINK_STABLE_TIME is how long a link must stay up before the reconnect attempts
+// start over; links dropped sooner count as failed attempts.
+const TCP_LINK_STABLE_TIME = 10 * time.Second
+
+// TCP_RECONNECT_MIN_DELAY is the floor of the TcpReconnect delays.
+const TCP_RECONNECT_MIN_DELAY = 100 * time.Millisecond
+
+type reconnectOption struct {
+	minDelay    time.Duration
+	maxDelay    time.Duration
+	maxAttempts int
+}
+
+// delay is an exponential backoff with equal jitter: half of the backoff is kept,
+// the other half is random, so a restarted server is not hit by every client at once.
+func (r *reconnectOption) delay(attempt int) time.Duration {
+	d := r.minDelay
+	for i := 1; i < attempt && d < r.maxDelay; i++ {
+		d *= 2
+	}
+	if d > r.maxDelay {
+		d = r.maxDelay
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
 type TcpClientMgr struct {
 	name          string
 	component_id  ComponentID
 	module        EventReceiver
 	agent_handler SessionHandler
 	option        TransportOption
+	tlsConfig     *tls.Config
+	reconnect     *reconnectOption
+	closeFlag     int32
 }
 
 func NewTcpClientMgr(opts ...Option) Component {
 	tcp_client := &TcpClientMgr{
 		component_id: GenComponentID(),
-		option: TransportOption{
-			msg_max_length: MSG_MAX_BODY_LENGTH,
-			msg_max_count:  MSG_DEFAULT_COUNT,
-		},
+		option:       newClientTransportOption(),
 	}
 
 	for _, opt := range opts {
@@ -51,17 +85,50 @@ func (this *TcpClientMgr) Start() bool {
 }
 
 func (this *TcpClientMgr) Close() {
+	atomic.StoreInt32(&this.closeFlag, 1)
+}
 
+func (this *TcpClientMgr) isRunning() bool {
+	return atomic.LoadInt32(&this.closeFlag) == 0
 }
 
 func (this *TcpClientMgr) Connect(addr string, user_type interface{}) {
-	go this.connect(addr, user_type)
+	go this.connect(addr, user_type, 0, 0)
+}
+
+func (this *TcpClientMgr) retry(addr string, user_type interface{}, attempt int, reconnects uint32) bool {
+	r := this.reconnect
+	if r == nil || this.isRunning() == false {
+		return false
+	}
+	if r.maxAttempts > 0 && attempt > r.maxAttempts {
+		slog.LogWarning("tcp_client", "tcp reconnect [%s] given up after %d attempts", addr, r.maxAttempts)
+		return false
+	}
+	delay := r.delay(attempt)
+	slog.LogInfo("tcp_client", "tcp reconnect [%s] attempt %d in %v", addr, attempt, delay)
+	time.AfterFunc(delay, func() {
+		if this.isRunning() == true {
+			this.connect(addr, user_type, attempt, reconnects)
+		}
+	})
+	return true
 }
 
-func (this *TcpClientMgr) connect(addr string, user_type interface{}) {
-	raw_conn, err := net.Dial("tcp", addr)
+func (this *TcpClientMgr) connect(addr string, user_type interface{}, attempt int, reconnects uint32) {
+	var raw_conn net.Conn
+	var err error
+	network, address := splitAddr(addr)
+	if this.tlsConfig != nil {
+		raw_conn, err = tls.Dial(network, address, this.tlsConfig)
+	} else {
+		raw_conn, err = net.Dial(network, address)
+	}
 	if err != nil {
 		slog.LogWarning("tcp_client", "tcp connect failed %v", err)
+		if this.retry(addr, user_type, attempt+1, reconnects) == true {
+			return
+		}
 		e := &event.ComponentEventMsg{}
 		e.MsgType = event.EVENT_COMPONENT_ERROR
 		e.Sender = this
@@ -74,15 +141,24 @@ func (this *TcpClientMgr) connect(addr string, user_type interface{}) {
 	m := this.module
 	h := this.agent_handler
 
-	tcp_agent := newTcpConn(raw_conn, h, Linker_TCP_OutGoing, &this.option)
+	tcp_agent := newTcpConn(raw_conn, h, Linker_TCP_OutGoing, m, this.component_id, &this.option)
 	tcp_agent.SetUserType(user_type)
+	tcp_agent.reconnects = reconnects
 	m.PostEvent(event.EVENT_TCP_CONNECTED, tcp_agent, this.component_id)
 
 	go func() {
+		linkTime := time.Now()
 		pingMgr.AddPing(tcp_agent)
 		err := tcp_agent.Run()
 		pingMgr.RemovePing(tcp_agent)
 		m.PostEvent(event.EVENT_TCP_CLOSED, tcp_agent, this.component_id, err)
+		if tcp_agent.isUserClosed() == false {
+			next := 1
+			if time.Since(linkTime) < TCP_LINK_STABLE_TIME {
+				next = attempt + 1
+			}
+			this.retry(addr, user_type, next, reconnects+1)
+		}
 	}()
 }
 
@@ -0,0 +1,79 @@
+package network
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+)
+
+var (
+	MSG_DECOMPRESS_ERR = errors.New("msg packet decompress error.")
+)
+
+// packetCompressor deflates packet bodies on the write goroutine and inflates them
+// on the read goroutine; each side only touches its own half.
+type packetCompressor struct {
+	writer   *zlib.Writer
+	wbuf     bytes.Buffer
+	reader   io.ReadCloser
+	rbuf     bytes.Buffer
+	inflated bytes.Reader
+}
+
+// compress deflates a packet body made of head (msg_id and seq_id) and data. It
+// returns nil when the result would not be smaller than the plain body.
+func (c *packetCompressor) compress(head []byte, data []byte) []byte {
+	c.wbuf.Reset()
+	if c.writer == nil {
+		c.writer = zlib.NewWriter(&c.wbuf)
+	} else {
+		c.writer.Reset(&c.wbuf)
+	}
+	c.writer.Write(head)
+	c.writer.Write(data)
+	if c.writer.Close() != nil || c.wbuf.Len() >= len(head)+len(data) {
+		return nil
+	}
+	return c.wbuf.Bytes()
+}
+
+// decompress inflates b, refusing bodies that expand beyond maxLength.
+func (c *packetCompressor) decompress(b []byte, maxLength uint32) ([]byte, error) {
+	c.inflated.Reset(b)
+	var err error
+	if c.reader == nil {
+		c.reader, err = zlib.NewReader(&c.inflated)
+	} else {
+		err = c.reader.(zlib.Resetter).Reset(&c.inflated, nil)
+	}
+	if err != nil {
+		return nil, MSG_DECOMPRESS_ERR
+	}
+
+	c.rbuf.Reset()
+	l, err := c.rbuf.ReadFrom(io.LimitReader(c.reader, int64(maxLength)))
+	if err != nil {
+		return nil, MSG_DECOMPRESS_ERR
+	}
+	if l >= int64(maxLength) {
+		return nil, MSG_TOO_LONG_ERR
+	}
+	return c.rbuf.Bytes(), nil
+}
+
+func (n *tcpTransport) compressBody(msg *TransportMsgPack, bodyLength int) []byte {
+	threshold := n.option.compress_threshold
+	if threshold <= 0 || bodyLength < threshold {
+		return nil
+	}
+
+	var head [MSG_ID_LENGTH + MSG_SEQ_LENGTH]byte
+	bigEndian.PutUint32(head[0:], msg.msgID)
+	headLength := MSG_ID_LENGTH
+	if isRpcMsgType(msg.msgType) == true {
+		bigEndian.PutUint32(head[MSG_ID_LENGTH:], msg.seqID)
+		headLength += MSG_SEQ_LENGTH
+	}
+	return n.compressor.compress(head[:headLength], msg.Buf)
+}
@@ -1,9 +1,8 @@
 package network
 
 import (
-	"errors"
+	"bufio"
 	"github.com/Cyinx/einx/agent"
-	"github.com/Cyinx/einx/queue"
 	"github.com/Cyinx/einx/slog"
 	"net"
 	"runtime/debug"
@@ -15,39 +14,76 @@ type TcpConn struct {
 	agentID      AgentID
 	conn         net.Conn
 	closeFlag    uint32
-	writeQueue   *queue.CondQueue
+	writeQueue   *linkWriteQueue
 	serveHandler SessionHandler
 	lastPingTick int64
 	remoteAddr   string
 	connType     int16
 	pingClose    int32
 	userType     interface{}
-
-	recvBuf       *BytesBuffer
-	writeBuf      *BytesBuffer
-	msgPacket     transPacket
-	recvCheckTime int64
-	msgRecvCount  int64
-	option        *TransportOption
+	module       EventReceiver
+	componentID  ComponentID
+	rpcCalls     *rpcCallMgr
+	userClose    int32
+	reconnects   uint32
+	wireVersion  int32
+
+	recvBuf        *BytesBuffer
+	writeBuf       *BytesBuffer
+	packedCount    int
+	packedBytes    int
+	msgPacket      transPacket
+	recvCheckTime  int64
+	msgRecvCount   int64
+	throttleTime   int64
+	closeLock      sync.Mutex
+	closeReason    *CloseReason
+	graceful       int32
+	loops          int32
+	groupLock      sync.Mutex
+	groups         map[*Group]bool
+	option         *TransportOption
+	versionChecked bool
+	compressor     packetCompressor
+	crypto         *packetCrypto
+	fragment       fragmentState
+	packetBuf      *BytesBuffer
+	readMsg        *MsgBuffer
+	reader         *bufio.Reader
+	packetCodec    PacketCodec
+	codecFrame     PacketFrame
+	codecBuf       []byte
 }
 
-func newTcpConn(raw_conn net.Conn, h SessionHandler, conn_type int16, opt *TransportOption) *TcpConn {
+func newTcpConn(raw_conn net.Conn, h SessionHandler, conn_type int16, m EventReceiver, cid ComponentID, opt *TransportOption) *TcpConn {
 	nowTime := UnixTS()
 	tcpAgent := &TcpConn{
 		conn:         raw_conn,
 		closeFlag:    0,
-		writeQueue:   queue.NewCondQueue(),
+		writeQueue:   newLinkWriteQueue(),
 		agentID:      agent.GenAgentID(),
 		serveHandler: h,
-		remoteAddr:   raw_conn.RemoteAddr().(*net.TCPAddr).String(),
+		remoteAddr:   connRemoteAddr(raw_conn).String(),
 		connType:     conn_type,
 		userType:     0,
+		module:       m,
+		componentID:  cid,
+		rpcCalls:     newRpcCallMgr(),
 
-		recvBuf:       bufferPool.Get().(*BytesBuffer),
-		writeBuf:      bufferPool.Get().(*BytesBuffer),
+		recvBuf:       getBuffer(0),
+		writeBuf:      getBuffer(0),
 		option:        opt,
 		lastPingTick:  nowTime,
 		recvCheckTime: nowTime,
+		msgRecvCount:  int64(opt.msg_max_count) * MSG_COUNT_CHECK_TIME,
+		throttleTime:  nowTime - MSG_COUNT_CHECK_TIME,
+		wireVersion:   opt.wire_version,
+	}
+	if conn_type == Linker_TCP_InComming && opt.wire_compat == true {
+		tcpAgent.wireVersion = MSG_VERSION_1
+	}
+	if opt.packet_codec != nil {
+		tcpAgent.packetCodec = opt.packet_codec()
 	}
 	return tcpAgent
 }
@@ -78,8 +114,27 @@ func (n *TcpConn) IsClosed() bool {
 }
 
 func (n *TcpConn) doPushWrite(wrapper ITransportMsg) bool {
-	n.writeQueue.Push(wrapper)
-	return true
+	opt := n.option
+	if n.writeQueue.Push(wrapper, opt.write_max_count, opt.write_max_bytes, opt.write_policy) == true {
+		return true
+	}
+
+	wrapper.reset()
+	if opt.write_policy == WRITE_CLOSE_LINK {
+		slog.LogWarning("tcp_conn", "linker [%v] remote [%v] write queue full, closed", n.agentID, n.remoteAddr)
+		n.setCloseReason(newCloseReason(CLOSE_WRITE_QUEUE_FULL, WRITE_QUEUE_FULL_ERR))
+		n.doClose()
+	}
+	return false
+}
+
+// QueuedBytes returns the msg count and body bytes queued or being written.
+func (n *TcpConn) QueuedBytes() (int, int) {
+	return n.writeQueue.Stat()
+}
+
+func (n *TcpConn) batchMaxSize() int {
+	return n.option.batch_max_size
 }
 
 func (n *TcpConn) MultipleMsg() ITranMsgMultiple {
@@ -121,15 +176,53 @@ func (n *TcpConn) LocalAddr() net.Addr {
 }
 
 func (n *TcpConn) RemoteAddr() net.Addr {
-	return n.conn.RemoteAddr()
+	return connRemoteAddr(n.conn)
+}
+
+// connRemoteAddr falls back to the local address when the peer has none, as
+// unnamed unix socket peers may on some platforms.
+func connRemoteAddr(c net.Conn) net.Addr {
+	if addr := c.RemoteAddr(); addr != nil {
+		return addr
+	}
+	return c.LocalAddr()
 }
 
 func (n *TcpConn) Close() {
+	atomic.StoreInt32(&n.userClose, 1)
+	n.setCloseReason(newCloseReason(CLOSE_NORMAL, nil))
+	n.doClose()
+}
+
+func (n *TcpConn) doClose() {
 	if atomic.CompareAndSwapUint32(&n.closeFlag, 0, 1) == true {
 		n.doPushWrite(nil)
 	}
 }
 
+func (n *TcpConn) setCloseReason(r *CloseReason) {
+	n.closeLock.Lock()
+	if n.closeReason == nil {
+		n.closeReason = r
+	}
+	n.closeLock.Unlock()
+}
+
+func (n *TcpConn) getCloseReason() *CloseReason {
+	n.closeLock.Lock()
+	r := n.closeReason
+	n.closeLock.Unlock()
+	return r
+}
+
+func (n *TcpConn) isUserClosed() bool {
+	return atomic.LoadInt32(&n.userClose) == 1
+}
+
+func (n *TcpConn) ReconnectCount() uint32 {
+	return n.reconnects
+}
+
 func (n *TcpConn) Destroy() {
 	if n.conn != nil {
 		_ = n.conn.Close()
@@ -139,18 +232,41 @@ func (n *TcpConn) Destroy() {
 func (n *TcpConn) Run() error {
 	defer n.recover()
 
+	n.reader = bufio.NewReaderSize(n.conn, MSG_DEFAULT_BUF_LENGTH*4)
+	if n.option.encrypt == true && n.packetCodec == nil {
+		if err := n.handshake(); err != nil {
+			slog.LogWarning("tcp_conn", "linker [%v] key exchange with [%v] error: %v", n.agentID, n.remoteAddr, err)
+			n.setCloseReason(recvCloseReason(err))
+			n.doClose()
+			n.Destroy()
+			n.failRpcCalls()
+			n.leaveGroups()
+			return n.getCloseReason()
+		}
+	}
+
+	atomic.StoreInt32(&n.loops, 2)
 	go func() {
 		defer n.recover()
-		if n.Write() == false {
-			n.Close()
+		n.Write()
+		n.doClose()
+		if n.isGraceful() == true {
+			n.lingerClose()
+		} else {
 			n.Destroy()
 		}
+		n.exitLoop()
 	}()
 
-	if n.Recv() == false {
-		return errors.New("tcp transport recv error")
+	n.Recv()
+	n.setCloseReason(newCloseReason(CLOSE_IO_ERROR, nil))
+	n.doClose()
+	n.leaveGroups()
+	if n.isGraceful() == false {
+		n.Destroy()
 	}
-	return nil
+	n.exitLoop()
+	return n.getCloseReason()
 }
 
 func (n *TcpConn) Pong(nowTick int64) {
@@ -186,7 +302,8 @@ func (n *TcpConn) Ping() bool {
 	}
 
 	atomic.StoreInt32(&n.pingClose, 1)
-	n.Close()
+	n.setCloseReason(newCloseReason(CLOSE_PING_TIMEOUT, nil))
+	n.doClose()
 	return false
 }
 
@@ -206,7 +323,7 @@ func (n *TcpConn) recover() {
 	}
 	slog.LogError("tcp_recovery", "recover error :%v", r)
 	slog.LogError("tcp_recovery", "%s", string(debug.Stack()))
-	n.Close()
+	n.doClose()
 	n.Destroy()
 }
 
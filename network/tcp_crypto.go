@@ -0,0 +1,169 @@
+package network
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"time"
+)
+
+const (
+	MSG_HANDSHAKE_TIMEOUT  = 10 * 1000 //Millisecond
+	PACKET_CRYPTO_OVERHEAD = 16        //AES-GCM tag
+)
+
+var (
+	MSG_HANDSHAKE_ERR = errors.New("msg packet key exchange error.")
+	MSG_DECRYPT_ERR   = errors.New("msg packet decrypt error.")
+)
+
+// Key exchange: once the link is up both peers send one 'K' packet whose body is
+// an X25519 public key of MSG_KEY_LENGTH bytes, before any other packet. Every
+// later 'P', 'R' and 'A' body is sealed with AES-256-GCM under a per direction key
+// and a per direction packet counter as nonce, and flagged PACKET_FLAG_ENCRYPT.
+// Peers are not authenticated: this protects against tampering and eavesdropping,
+// use TLS when the server identity has to be verified.
+type packetCrypto struct {
+	sealer    cipher.AEAD
+	opener    cipher.AEAD
+	sealSeq   uint64
+	openSeq   uint64
+	sealNonce [12]byte
+	openNonce [12]byte
+}
+
+func deriveKey(label string, shared []byte, clientKey []byte, serverKey []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(label))
+	h.Write(shared)
+	h.Write(clientKey)
+	h.Write(serverKey)
+	return h.Sum(nil)
+}
+
+func newPacketAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newPacketCrypto(shared []byte, localKey []byte, peerKey []byte, isClient bool) (*packetCrypto, error) {
+	clientKey, serverKey := localKey, peerKey
+	if isClient == false {
+		clientKey, serverKey = peerKey, localKey
+	}
+
+	c2s, err := newPacketAEAD(deriveKey("einx c2s", shared, clientKey, serverKey))
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := newPacketAEAD(deriveKey("einx s2c", shared, clientKey, serverKey))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &packetCrypto{sealer: c2s, opener: s2c}
+	if isClient == false {
+		c.sealer, c.opener = s2c, c2s
+	}
+	return c, nil
+}
+
+// nonce fills a per direction buffer: seal runs on the write loop, open on the read loop.
+func nonce(buf *[12]byte, seq uint64) []byte {
+	bigEndian.PutUint64(buf[4:], seq)
+	return buf[:]
+}
+
+func (c *packetCrypto) overhead() int {
+	return c.sealer.Overhead()
+}
+
+// seal encrypts the last bodyLength bytes written to buf in place.
+func (c *packetCrypto) seal(buf *BytesBuffer, bodyLength int, aad []byte) {
+	body := buf.buf[buf.w-bodyLength : buf.w]
+	c.sealer.Seal(body[:0], nonce(&c.sealNonce, c.sealSeq), body, aad)
+	c.sealSeq++
+	buf.write(c.sealer.Overhead())
+}
+
+func (c *packetCrypto) open(b []byte, aad []byte) ([]byte, error) {
+	plain, err := c.opener.Open(b[:0], nonce(&c.openNonce, c.openSeq), b, aad)
+	if err != nil {
+		return nil, MSG_DECRYPT_ERR
+	}
+	c.openSeq++
+	return plain, nil
+}
+
+// handshake runs the key exchange before the read and write loops start, so no
+// other packet can go out or be accepted unencrypted. The incoming side reads the
+// peer's key first, so its own key goes out in the peer's wire version.
+func (n *tcpTransport) handshake() error {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	localKey := priv.PublicKey().Bytes()
+
+	conn := n.conn
+	deadline := time.Now().Add(MSG_HANDSHAKE_TIMEOUT * time.Millisecond)
+	_ = conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	var peerKey []byte
+	if n.connType == Linker_TCP_InComming {
+		if peerKey, err = n.readHandshakeKey(); err != nil {
+			return err
+		}
+	}
+
+	buf := n.writeBuf
+	buf.Reset()
+	buf.Reserve(MSG_HEADER_LENGTH_V2 + MSG_KEY_LENGTH)
+	n.writeHeader(buf, n.getWireVersion(), 'K', 0, MSG_KEY_LENGTH)
+	buf.WriteBytes(localKey)
+	if _, err := conn.Write(buf.ReadBuf(buf.Count())); err != nil {
+		return err
+	}
+
+	if peerKey == nil {
+		if peerKey, err = n.readHandshakeKey(); err != nil {
+			return err
+		}
+	}
+
+	pub, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return MSG_HANDSHAKE_ERR
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return MSG_HANDSHAKE_ERR
+	}
+
+	c, err := newPacketCrypto(shared, localKey, peerKey, n.connType == Linker_TCP_OutGoing)
+	if err != nil {
+		return err
+	}
+	n.crypto = c
+	return nil
+}
+
+func (n *tcpTransport) readHandshakeKey() ([]byte, error) {
+	_, peerKey, err := n.ReadMsgPacket(n.reader)
+	if err != nil {
+		return nil, err
+	}
+	if n.msgPacket.MsgType != 'K' {
+		return nil, MSG_HANDSHAKE_ERR
+	}
+	key := make([]byte, len(peerKey))
+	copy(key, peerKey)
+	return key, nil
+}
@@ -0,0 +1,219 @@
+package network
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	ACCEPT_OK          = ""
+	ACCEPT_DENIED      = "ip denied"
+	ACCEPT_NOT_ALLOWED = "ip not allowed"
+	ACCEPT_MAX_CONN    = "max connections"
+	ACCEPT_MAX_PER_IP  = "max connections per ip"
+	ACCEPT_RATE_LIMIT  = "accept rate limit"
+)
+
+const ACCEPT_LOG_INTERVAL = 10 * 1000 //Millisecond
+
+// acceptFilter decides which accepted connections a TcpServerMgr serves. The
+// accept rate is a token bucket in thousandths of a connection, like the msg rate.
+type acceptFilter struct {
+	lock     sync.Mutex
+	maxConns int
+	maxPerIP int
+	rate     int
+	tokens   int64
+	rateTick int64
+	conns    int
+	ipConns  map[string]int
+	allow    []*net.IPNet
+	deny     []*net.IPNet
+	rejected uint64
+	logged   uint64
+	logTick  int64
+}
+
+func newAcceptFilter() *acceptFilter {
+	return &acceptFilter{
+		ipConns: make(map[string]int),
+	}
+}
+
+// parseCIDRs parses CIDR blocks, a bare ip is taken as a single address block.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if strings.Contains(s, "/") == false {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func matchCIDRs(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) == true {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the ip of a tcp remote address, nil for other address kinds.
+func remoteIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	if a, ok := addr.(*net.TCPAddr); ok == true {
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func (f *acceptFilter) setIPFilter(allow []*net.IPNet, deny []*net.IPNet) {
+	f.lock.Lock()
+	f.allow = allow
+	f.deny = deny
+	f.lock.Unlock()
+}
+
+// accept counts a new connection from ip, or returns why it is rejected.
+func (f *acceptFilter) accept(ip net.IP, nowTick int64) string {
+	f.lock.Lock()
+	reason := f.checkIP(ip)
+	if reason == ACCEPT_OK {
+		reason = f.checkConns(nowTick)
+	}
+	if reason == ACCEPT_OK {
+		f.conns++
+		if ip != nil {
+			f.ipConns[ip.String()]++
+		}
+	}
+	f.lock.Unlock()
+	return f.result(reason)
+}
+
+// reserve counts a new connection whose ip is not known yet against the global
+// limits; admit then checks its ip once known.
+func (f *acceptFilter) reserve(nowTick int64) string {
+	f.lock.Lock()
+	reason := f.checkConns(nowTick)
+	if reason == ACCEPT_OK {
+		f.conns++
+	}
+	f.lock.Unlock()
+	return f.result(reason)
+}
+
+// admit counts ip for a connection counted by reserve, or uncounts the connection
+// and returns why it is rejected.
+func (f *acceptFilter) admit(ip net.IP) string {
+	f.lock.Lock()
+	reason := f.checkIP(ip)
+	if reason == ACCEPT_OK {
+		if ip != nil {
+			f.ipConns[ip.String()]++
+		}
+	} else {
+		f.conns--
+	}
+	f.lock.Unlock()
+	return f.result(reason)
+}
+
+func (f *acceptFilter) result(reason string) string {
+	if reason != ACCEPT_OK {
+		atomic.AddUint64(&f.rejected, 1)
+	}
+	return reason
+}
+
+func (f *acceptFilter) checkIP(ip net.IP) string {
+	if ip == nil {
+		return ACCEPT_OK
+	}
+	if matchCIDRs(f.deny, ip) == true {
+		return ACCEPT_DENIED
+	}
+	if len(f.allow) > 0 && matchCIDRs(f.allow, ip) == false {
+		return ACCEPT_NOT_ALLOWED
+	}
+	if f.maxPerIP > 0 && f.ipConns[ip.String()] >= f.maxPerIP {
+		return ACCEPT_MAX_PER_IP
+	}
+	return ACCEPT_OK
+}
+
+func (f *acceptFilter) checkConns(nowTick int64) string {
+	if f.maxConns > 0 && f.conns >= f.maxConns {
+		return ACCEPT_MAX_CONN
+	}
+
+	if f.rate > 0 {
+		limit := int64(f.rate) * 1000
+		f.tokens += (nowTick - f.rateTick) * int64(f.rate)
+		f.rateTick = nowTick
+		if f.tokens > limit {
+			f.tokens = limit
+		}
+		if f.tokens < 1000 {
+			return ACCEPT_RATE_LIMIT
+		}
+		f.tokens -= 1000
+	}
+	return ACCEPT_OK
+}
+
+// rejectLog reports whether a rejection warning is due, at most one per
+// ACCEPT_LOG_INTERVAL, and the rejections since the last one.
+func (f *acceptFilter) rejectLog(nowTick int64) (uint64, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.logTick != 0 && nowTick-f.logTick < ACCEPT_LOG_INTERVAL {
+		return 0, false
+	}
+	rejected := atomic.LoadUint64(&f.rejected)
+	count := rejected - f.logged
+	f.logTick = nowTick
+	f.logged = rejected
+	return count, true
+}
+
+// release uncounts a closed connection accepted from ip.
+func (f *acceptFilter) release(ip net.IP) {
+	f.lock.Lock()
+	f.conns--
+	if ip != nil {
+		key := ip.String()
+		if f.ipConns[key] <= 1 {
+			delete(f.ipConns, key)
+		} else {
+			f.ipConns[key]--
+		}
+	}
+	f.lock.Unlock()
+}
+
+func (f *acceptFilter) stat() (int, uint64) {
+	f.lock.Lock()
+	conns := f.conns
+	f.lock.Unlock()
+	return conns, atomic.LoadUint64(&f.rejected)
+}
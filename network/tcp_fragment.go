@@ -0,0 +1,115 @@
+package network
+
+import (
+	"errors"
+)
+
+var (
+	MSG_FRAGMENT_ERR       = errors.New("msg packet fragment sequence error.")
+	MSG_FRAGMENT_TOTAL_ERR = errors.New("msg packet fragments over total length.")
+)
+
+// A message body (after compression) longer than one packet is split over several
+// packets of the same type, all flagged PACKET_FLAG_FRAGMENT and the last one also
+// PACKET_FLAG_FRAGMENT_END. Fragments of a message are written back to back by the
+// write goroutine, so the receiver only ever reassembles one message at a time.
+type fragmentState struct {
+	msgType byte
+	flag    uint8
+	buf     *BytesBuffer
+}
+
+// fragmentLength is the largest body a single packet carries, 0 when fragmentation
+// is disabled.
+func (n *tcpTransport) fragmentLength() int {
+	if n.option.msg_max_total == 0 {
+		return 0
+	}
+	l := int(n.option.msg_max_length) - 1
+	if n.crypto != nil {
+		l -= n.crypto.overhead()
+	}
+	if n.getWireVersion() == MSG_VERSION_1 && l > MSG_MAX_BODY_LENGTH_V1 {
+		l = MSG_MAX_BODY_LENGTH_V1
+	}
+	return l
+}
+
+// msgMaxSize is the largest msg body, msg_id included, the writer sends instead of
+// dropping it, 0 for no limit. Compression only ever makes a body shorter.
+func (n *tcpTransport) msgMaxSize() int {
+	if n.packetCodec != nil {
+		return 0
+	}
+	if n.option.msg_max_total > 0 {
+		return int(n.option.msg_max_total)
+	}
+	if n.getWireVersion() != MSG_VERSION_1 {
+		return 0
+	}
+	l := MSG_MAX_BODY_LENGTH_V1
+	if n.option.encrypt == true {
+		l -= PACKET_CRYPTO_OVERHEAD
+	}
+	return l
+}
+
+func (n *tcpTransport) maxMsgLength() uint32 {
+	if n.option.msg_max_total > n.option.msg_max_length {
+		return n.option.msg_max_total
+	}
+	return n.option.msg_max_length
+}
+
+func (n *tcpTransport) joinBody(msg *TransportMsgPack) []byte {
+	headLength := MSG_ID_LENGTH
+	if isRpcMsgType(msg.msgType) == true {
+		headLength += MSG_SEQ_LENGTH
+	}
+	body := make([]byte, headLength+len(msg.Buf))
+	bigEndian.PutUint32(body, msg.msgID)
+	if isRpcMsgType(msg.msgType) == true {
+		bigEndian.PutUint32(body[MSG_ID_LENGTH:], msg.seqID)
+	}
+	copy(body[headLength:], msg.Buf)
+	return body
+}
+
+// reassemble collects one fragment and returns the whole body once the last one
+// arrived, nil before that.
+func (n *tcpTransport) reassemble(b []byte) ([]byte, error) {
+	msgPacket := &n.msgPacket
+	f := &n.fragment
+	flag := msgPacket.PacketFlag &^ (PACKET_FLAG_FRAGMENT | PACKET_FLAG_FRAGMENT_END)
+
+	if f.msgType == 0 {
+		f.msgType = msgPacket.MsgType
+		f.flag = flag
+	} else if f.msgType != msgPacket.MsgType || f.flag != flag {
+		return nil, MSG_FRAGMENT_ERR
+	}
+
+	if f.buf == nil {
+		f.buf = getBuffer(len(b))
+	}
+	buf := f.buf
+	if uint32(buf.Count()+len(b)) > n.option.msg_max_total {
+		return nil, MSG_FRAGMENT_TOTAL_ERR
+	}
+	if buf.c-buf.w < len(b) {
+		buf.Reserve(len(b) + buf.Count())
+	}
+	buf.WriteBytes(b)
+	putBuffer(n.packetBuf)
+	n.packetBuf = nil
+
+	if msgPacket.PacketFlag&PACKET_FLAG_FRAGMENT_END == 0 {
+		return nil, nil
+	}
+
+	n.packetBuf = buf
+	f.msgType = 0
+	f.flag = 0
+	f.buf = nil
+	return buf.ReadBuf(buf.Count()), nil
+}
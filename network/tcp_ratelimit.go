@@ -0,0 +1,71 @@
+package network
+
+import (
+	"errors"
+	"github.com/Cyinx/einx/event"
+	"github.com/Cyinx/einx/slog"
+	"time"
+)
+
+const (
+	RATE_LIMIT_DROP = iota + 1
+	RATE_LIMIT_DELAY
+	RATE_LIMIT_CLOSE
+)
+
+var (
+	MSG_RATE_LIMIT_ERR = errors.New("tcp transport msg rate limited.")
+)
+
+// checkRecvRate takes a token for an inbound 'P' or 'R' msg. The bucket is refilled
+// at msg_max_count per second and holds MSG_COUNT_CHECK_TIME worth of msgs as burst;
+// msgRecvCount keeps the tokens in thousandths and recvCheckTime the last refill.
+// It returns false when the msg must not be served.
+func (n *tcpTransport) checkRecvRate(nowTick int64) bool {
+	rate := int64(n.option.msg_max_count)
+	if rate <= 0 {
+		return true
+	}
+
+	n.refillRecvRate(nowTick, rate)
+	if n.msgRecvCount >= 1000 {
+		n.msgRecvCount -= 1000
+		return true
+	}
+
+	action := n.option.rate_limit_action
+	n.onThrottled(nowTick, action)
+
+	switch action {
+	case RATE_LIMIT_DELAY:
+		wait := (1000 - n.msgRecvCount + rate - 1) / rate
+		time.Sleep(time.Duration(wait) * time.Millisecond)
+		n.refillRecvRate(UnixTS(), rate)
+		n.msgRecvCount -= 1000
+		return true
+	case RATE_LIMIT_CLOSE:
+		n.closeWithReason(newCloseReason(CLOSE_RATE_LIMIT, MSG_RATE_LIMIT_ERR))
+	}
+	return false
+}
+
+func (n *tcpTransport) refillRecvRate(nowTick int64, rate int64) {
+	n.msgRecvCount += (nowTick - n.recvCheckTime) * rate
+	n.recvCheckTime = nowTick
+	if burst := rate * MSG_COUNT_CHECK_TIME; n.msgRecvCount > burst {
+		n.msgRecvCount = burst
+	}
+}
+
+// onThrottled tells the owning module about the throttle, at most once per
+// MSG_COUNT_CHECK_TIME so a flooding peer cannot flood the module as well.
+func (n *tcpTransport) onThrottled(nowTick int64, action int) {
+	if nowTick-n.throttleTime < MSG_COUNT_CHECK_TIME && action != RATE_LIMIT_CLOSE {
+		return
+	}
+	n.throttleTime = nowTick
+	slog.LogWarning("tcp_transport", "linker [%v] remote [%v] over msg rate %d/s, action %d", n.agentID, n.remoteAddr, n.option.msg_max_count, action)
+	if n.module != nil {
+		n.module.PostEvent(event.EVENT_TCP_THROTTLED, n, n.componentID, action)
+	}
+}
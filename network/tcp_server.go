@@ -1,14 +1,25 @@
 package network
 
 import (
+	"crypto/tls"
+	"errors"
 	"github.com/Cyinx/einx/event"
 	"github.com/Cyinx/einx/slog"
 	"net"
+	"os"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-const TCP_ACCEPT_SLEEP = 150
+const (
+	TCP_ACCEPT_SLEEP         = 150
+	TCP_STALE_SOCKET_TIMEOUT = time.Second
+)
+
+var (
+	UNIX_ADDR_IN_USE_ERR = errors.New("unix socket address already in use.")
+)
 
 type TcpServerMgr struct {
 	name         string
@@ -19,6 +30,10 @@ type TcpServerMgr struct {
 	addr         string
 	closeFlag    int32
 	option       TransportOption
+	tlsConfig    *tls.Config
+	filter       *acceptFilter
+	proxyProto   bool
+	proxyTrusted []*net.IPNet
 }
 
 func NewTcpServerMgr(opts ...Option) Component {
@@ -26,6 +41,7 @@ func NewTcpServerMgr(opts ...Option) Component {
 		componentID: GenComponentID(),
 		closeFlag:   0,
 		option:      newTransportOption(),
+		filter:      newAcceptFilter(),
 	}
 
 	for _, opt := range opts {
@@ -59,11 +75,21 @@ func (this *TcpServerMgr) Address() net.Addr {
 }
 
 func (this *TcpServerMgr) Start() bool {
-	listener, err := net.Listen("tcp", this.addr)
+	network, address := splitAddr(this.addr)
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			slog.LogError("tcp_server", "ListenTCP addr:[%s],Error:%s", this.addr, err.Error())
+			return false
+		}
+	}
+	listener, err := net.Listen(network, address)
 	if err != nil {
 		slog.LogError("tcp_server", "ListenTCP addr:[%s],Error:%s", this.addr, err.Error())
 		return false
 	}
+	if this.tlsConfig != nil && this.proxyProto == false {
+		listener = tls.NewListener(listener, this.tlsConfig)
+	}
 	this.listener = listener
 	go this.doTcpAccept()
 	return true
@@ -84,8 +110,6 @@ func (this *TcpServerMgr) isRunning() bool {
 }
 
 func (this *TcpServerMgr) doTcpAccept() {
-	m := this.module
-	h := this.agentHandler
 	listener := this.listener
 
 	for this.isRunning() {
@@ -99,18 +123,130 @@ func (this *TcpServerMgr) doTcpAccept() {
 			continue
 		}
 
-		tcpAgent := newTcpConn(rawConn, h, Linker_TCP_InComming, &this.option)
-		m.PostEvent(event.EVENT_TCP_ACCEPTED, tcpAgent, this.componentID)
+		if this.proxyProto == true {
+			if this.isProxyTrusted(rawConn) == true {
+				if reason := this.filter.reserve(UnixTS()); reason != ACCEPT_OK {
+					this.reject(rawConn, reason)
+					continue
+				}
+				go this.serveProxyConn(rawConn)
+				continue
+			}
+			if this.tlsConfig != nil {
+				rawConn = tls.Server(rawConn, this.tlsConfig)
+			}
+		}
 
-		go func() {
-			pingMgr.AddPing(tcpAgent)
-			err := tcpAgent.Run()
-			pingMgr.RemovePing(tcpAgent)
-			m.PostEvent(event.EVENT_TCP_CLOSED, tcpAgent, this.componentID, err)
-		}()
+		if ip, ok := this.acceptConn(rawConn); ok == true {
+			go this.serveConn(rawConn, ip)
+		}
 	}
 }
 
+// isProxyTrusted reports whether the PROXY protocol header of rawConn is read, which
+// is every connection when no trusted proxy is set.
+func (this *TcpServerMgr) isProxyTrusted(rawConn net.Conn) bool {
+	if len(this.proxyTrusted) == 0 {
+		return true
+	}
+	ip := remoteIP(rawConn.RemoteAddr())
+	return ip != nil && matchCIDRs(this.proxyTrusted, ip) == true
+}
+
+// serveProxyConn reads the PROXY protocol header of a connection already counted
+// against the global limits, so the ip checks and the session see the client
+// address. TLS starts after the header.
+func (this *TcpServerMgr) serveProxyConn(rawConn net.Conn) {
+	conn, err := readProxyHeader(rawConn)
+	if err != nil {
+		slog.LogWarning("tcp_server", "server [%s] proxy header from [%v] error: %v", this.name, rawConn.RemoteAddr(), err)
+		this.filter.release(nil)
+		_ = rawConn.Close()
+		return
+	}
+
+	if this.tlsConfig != nil {
+		conn = tls.Server(conn, this.tlsConfig)
+	}
+
+	ip := remoteIP(conn.RemoteAddr())
+	if reason := this.filter.admit(ip); reason != ACCEPT_OK {
+		this.reject(conn, reason)
+		return
+	}
+	this.serveConn(conn, ip)
+}
+
+// acceptConn applies the accept filter and returns the remote ip counted for rawConn.
+func (this *TcpServerMgr) acceptConn(rawConn net.Conn) (net.IP, bool) {
+	ip := remoteIP(rawConn.RemoteAddr())
+	if reason := this.filter.accept(ip, UnixTS()); reason != ACCEPT_OK {
+		this.reject(rawConn, reason)
+		return nil, false
+	}
+	return ip, true
+}
+
+// reject closes a rejected connection. Warnings are throttled, a flood of rejected
+// connections is reported with its count.
+func (this *TcpServerMgr) reject(conn net.Conn, reason string) {
+	if count, ok := this.filter.rejectLog(UnixTS()); ok == true {
+		slog.LogWarning("tcp_server", "server [%s] rejected [%v]: %s, %d rejected since last warning", this.name, conn.RemoteAddr(), reason, count)
+	}
+	_ = conn.Close()
+}
+
+func (this *TcpServerMgr) serveConn(rawConn net.Conn, ip net.IP) {
+	m := this.module
+	tcpAgent := newTcpConn(rawConn, this.agentHandler, Linker_TCP_InComming, m, this.componentID, &this.option)
+	m.PostEvent(event.EVENT_TCP_ACCEPTED, tcpAgent, this.componentID)
+
+	pingMgr.AddPing(tcpAgent)
+	err := tcpAgent.Run()
+	pingMgr.RemovePing(tcpAgent)
+	this.filter.release(ip)
+	m.PostEvent(event.EVENT_TCP_CLOSED, tcpAgent, this.componentID, err)
+}
+
 func (this *TcpServerMgr) GetOption() *TransportOption {
 	return &this.option
 }
+
+// SetIPFilter replaces the CIDR allow and deny lists, it is safe to call at runtime.
+// Deny wins over allow; an empty allow list allows every ip not denied.
+func (this *TcpServerMgr) SetIPFilter(allow []string, deny []string) error {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return err
+	}
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return err
+	}
+	this.filter.setIPFilter(allowNets, denyNets)
+	return nil
+}
+
+// ConnStat returns the connections being served and the count of rejected ones.
+func (this *TcpServerMgr) ConnStat() (int, uint64) {
+	return this.filter.stat()
+}
+
+// removeStaleSocket removes a unix socket file left behind by a previous process,
+// which would make listening on it fail. A socket still accepting connections is
+// in use and left alone, as is any other kind of file.
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", path, TCP_STALE_SOCKET_TIMEOUT)
+	if err == nil {
+		_ = conn.Close()
+		return UNIX_ADDR_IN_USE_ERR
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) == true {
+		return os.Remove(path)
+	}
+	return nil
+}
@@ -3,187 +3,569 @@ package network
 import (
 	"encoding/binary"
 	"errors"
+	"github.com/Cyinx/einx/slog"
 	"io"
-	"net"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	MSG_KEY_LENGTH         = 32
 	MSG_HEADER_LENGTH      = 4
+	MSG_HEADER_LENGTH_V2   = 7
 	MSG_ID_LENGTH          = 4
+	MSG_SEQ_LENGTH         = 4
 	MSG_MAX_BODY_LENGTH    = 8096
+	MSG_MAX_BODY_LENGTH_V1 = 0xffff
 	MSG_DEFAULT_BUF_LENGTH = 1024
+	MSG_DEFAULT_FLUSH_SIZE = 64 * 1024
+	MSG_DEFAULT_BATCH_SIZE = 256 * 1024
 	MSG_DEFAULT_COUNT      = 100
 	MSG_COUNT_CHECK_TIME   = 3000
 )
 
+const (
+	MSG_VERSION_1 = 1
+	MSG_VERSION_2 = 2
+	MSG_MAGIC_V2  = 0xe2
+)
+
 var bigEndian = binary.BigEndian
 
+var (
+	MSG_TOO_LONG_ERR = errors.New("msg packet length too long.")
+)
+
+// version 1 (compatibility mode, body length is limited to 64KB):
 // --------------------------------------------------------------------------------------------------------
 // |                                header              |                body                          |
 // | type byte | body_length uint16 | packet_flag uint8 | msg_id uint32| msg_data []byte               |
 // --------------------------------------------------------------------------------------------------------
-var msgHeaderLength int = MSG_HEADER_LENGTH
+// version 2:
+// --------------------------------------------------------------------------------------------------------
+// |                                     header                           |             body              |
+// | magic 0xe2 | type byte | packet_flag uint8 | body_length uint32      | msg_id uint32| msg_data []byte|
+// --------------------------------------------------------------------------------------------------------
+// The version of an incoming link is taken from the first byte the peer sends: the v2 magic can never be
+// a v1 packet type. 'R' (rpc request) and 'A' (rpc answer) bodies carry a call sequence id after msg_id:
+// | msg_id uint32 | seq_id uint32 | msg_data []byte |, seq_id 0 means no answer is expected.
+// 'K' (key exchange) bodies are a bare public key of MSG_KEY_LENGTH bytes, see tcp_crypto.go.
+// 'C' (close) bodies are | close_code uint16 | reason []byte |, sent last before a graceful close.
+//
+// packet_flag bits:
+const (
+	PACKET_FLAG_COMPRESS     = 1 << 0
+	PACKET_FLAG_ENCRYPT      = 1 << 1
+	PACKET_FLAG_FRAGMENT     = 1 << 2
+	PACKET_FLAG_FRAGMENT_END = 1 << 3
+)
 
 type transPacket struct {
 	MsgType    byte
-	BodyLength uint16
+	BodyLength uint32
 	PacketFlag uint8
+	RpcSeqID   uint32
 }
 
 type tcpTransport = TcpConn
 
+// Write packs every queued msg into writeBuf and flushes once per batch, or
+// whenever write_flush_size bytes are pending. With write_flush_delay set it waits
+// that long before a flush so more msgs can join the same write.
 func (n *tcpTransport) Write() bool {
-	tcpConn := n.conn
 	wq := n.writeQueue
 	msgList := make([]interface{}, 16)
 	for {
 		c := wq.Get(msgList, 16)
-		for i := uint32(0); i < c; i++ {
-			m := msgList[i]
-			if m == nil {
-				goto writeClose
-			}
-			wg := m.(ITransportMsg)
-			if n.WriteMsgPacket(tcpConn, wg) == false {
-				goto writeClose
+		if n.packBatch(msgList, c) == false {
+			goto writeClose
+		}
+
+		if delay := n.option.write_flush_delay; delay > 0 && n.writeBuf.Count() < n.option.write_flush_size {
+			time.Sleep(delay)
+			for n.writeBuf.Count() < n.option.write_flush_size {
+				c = wq.Poll(msgList, 16)
+				if c == 0 {
+					break
+				}
+				if n.packBatch(msgList, c) == false {
+					goto writeClose
+				}
 			}
-			msgList[i] = nil
-			wg.reset()
+		}
+
+		if n.flushWriteBuf() == false {
+			goto writeClose
 		}
 	}
 writeClose:
+	n.donePacked()
 	buf := n.writeBuf
 	n.writeBuf = nil
 	bufferPool.Put(buf)
 	return false
 }
 
-func (n *tcpTransport) WriteMsgPacket(conn net.Conn, msg ITransportMsg) bool {
+// packBatch packs msgList[:c], flushing early when writeBuf is full. It returns
+// false on a write error or once the close marker has been reached.
+func (n *tcpTransport) packBatch(msgList []interface{}, c uint32) bool {
+	for i := uint32(0); i < c; i++ {
+		m := msgList[i]
+		msgList[i] = nil
+		if m == nil {
+			n.flushWriteBuf()
+			return false
+		}
+		wg := m.(ITransportMsg)
+		if isCountedMsg(wg) == true {
+			n.packedCount++
+			n.packedBytes += transportMsgSize(wg)
+		}
+		ok := n.packMsgPacket(wg)
+		wg.reset()
+		if ok == false {
+			return false
+		}
+		if n.writeBuf.Count() >= n.option.write_flush_size && n.flushWriteBuf() == false {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *tcpTransport) packMsgPacket(msg ITransportMsg) bool {
+	if n.packetCodec != nil {
+		n.packCodecMsg(msg)
+		return true
+	}
+
 	switch msg.GetType() {
-	case 'P', 'R':
+	case 'P', 'R', 'A':
 		tsBuf := msg.(*TransportMsgPack)
 		n.packMsgBuf(tsBuf)
 	case 'T':
 		n.packPingMsg()
+	case 'C':
+		n.packCloseMsg(msg.(*TransportMsgPack))
+	case 'G':
+		n.packGroupMsg(msg.(*groupFrame))
+	case 'B':
+		for _, m := range msg.(*TransportMultiple).msgArray {
+			n.packMsgBuf(m)
+		}
 	default:
 		return false
 	}
+	return true
+}
 
+// flushWriteBuf writes writeBuf out, the packed msgs leave the write queue count
+// only then.
+func (n *tcpTransport) flushWriteBuf() bool {
+	defer n.donePacked()
 	buf := n.writeBuf
-	rb := buf.ReadBuf(buf.Count())
-	_, err := conn.Write(rb)
-	if err == nil {
+	if buf.Count() == 0 {
 		return true
 	}
-	return false
+	_, err := n.conn.Write(buf.ReadBuf(buf.Count()))
+	return err == nil
+}
+
+func (n *tcpTransport) donePacked() {
+	n.writeQueue.Done(n.packedCount, n.packedBytes)
+	n.packedCount = 0
+	n.packedBytes = 0
 }
 
 func (n *tcpTransport) packMsgBuf(msg *TransportMsgPack) {
-	mBytes := msg.Buf
-	var bodyLength int = len(mBytes) + MSG_ID_LENGTH
-	var msgLength int = bodyLength + MSG_HEADER_LENGTH
+	var bodyLength int = len(msg.Buf) + MSG_ID_LENGTH
+	if isRpcMsgType(msg.msgType) == true {
+		bodyLength += MSG_SEQ_LENGTH
+	}
+
+	var flag uint8 = 0
+	compressed := n.compressBody(msg, bodyLength)
+	if compressed != nil {
+		flag |= PACKET_FLAG_COMPRESS
+		bodyLength = len(compressed)
+	}
+
+	fragLength := n.fragmentLength()
+	if fragLength <= 0 || bodyLength <= fragLength {
+		n.packPacket(msg, flag, compressed)
+		return
+	}
+
+	if uint32(bodyLength) > n.option.msg_max_total {
+		slog.LogError("tcp_transport", "linker [%v] msg [%v] length %d over fragment total limit, dropped", n.agentID, msg.msgID, bodyLength)
+		return
+	}
+
+	body := compressed
+	if body == nil {
+		body = n.joinBody(msg)
+	}
+	for i := 0; i < len(body); i += fragLength {
+		end := i + fragLength
+		fragFlag := flag | PACKET_FLAG_FRAGMENT
+		if end >= len(body) {
+			end = len(body)
+			fragFlag |= PACKET_FLAG_FRAGMENT_END
+		}
+		n.packPacket(msg, fragFlag, body[i:end])
+	}
+}
+
+// packPacket writes one packet carrying body, or the msg_id, seq_id and data of msg
+// when body is nil.
+func (n *tcpTransport) packPacket(msg *TransportMsgPack, flag uint8, body []byte) {
+	bodyLength := len(body)
+	if body == nil {
+		bodyLength = len(msg.Buf) + MSG_ID_LENGTH
+		if isRpcMsgType(msg.msgType) == true {
+			bodyLength += MSG_SEQ_LENGTH
+		}
+	}
+
+	packetLength := bodyLength
+	if n.crypto != nil {
+		flag |= PACKET_FLAG_ENCRYPT
+		packetLength += n.crypto.overhead()
+	}
+
+	version := n.getWireVersion()
+	if version == MSG_VERSION_1 && packetLength > MSG_MAX_BODY_LENGTH_V1 {
+		slog.LogError("tcp_transport", "linker [%v] msg [%v] length %d too long for wire version 1, dropped", n.agentID, msg.msgID, packetLength)
+		return
+	}
 
 	buf := n.writeBuf
-	buf.Reserve(msgLength)
+	buf.Reserve(packetLength + MSG_HEADER_LENGTH_V2)
 
 	var wl int = 0
-	wl += buf.WriteUint8(msg.msgType)
-	wl += buf.WriteUint32(uint32(bodyLength))
-	wl += buf.WriteUint8(0)
+	wl += n.writeHeader(buf, version, msg.msgType, flag, packetLength)
+	if body != nil {
+		wl += buf.WriteBytes(body)
+	} else {
+		wl += buf.WriteUint32(msg.msgID)
+		if isRpcMsgType(msg.msgType) == true {
+			wl += buf.WriteUint32(msg.seqID)
+		}
+		wl += buf.WriteBytes(msg.Buf)
+	}
 
-	wl += buf.WriteUint32(msg.msgID)
-	wl += buf.WriteBytes(mBytes)
+	if n.crypto != nil {
+		n.crypto.seal(buf, bodyLength, []byte{msg.msgType, flag})
+	}
+}
+
+func isRpcMsgType(t byte) bool {
+	return t == 'R' || t == 'A'
+}
+
+func (n *tcpTransport) writeHeader(buf *BytesBuffer, version int32, msgType byte, flag uint8, bodyLength int) int {
+	var wl int = 0
+	if version == MSG_VERSION_1 {
+		wl += buf.WriteUint8(msgType)
+		wl += buf.WriteUint16(uint16(bodyLength))
+		wl += buf.WriteUint8(flag)
+		return wl
+	}
+	wl += buf.WriteUint8(MSG_MAGIC_V2)
+	wl += buf.WriteUint8(msgType)
+	wl += buf.WriteUint8(flag)
+	wl += buf.WriteUint32(uint32(bodyLength))
+	return wl
 }
 
 func (n *tcpTransport) packPingMsg() {
 	buf := n.writeBuf
-	buf.Reserve(MSG_HEADER_LENGTH)
-	buffer := buf.WriteBuf()
-	buffer[0] = 'T'
-	buffer[1] = 0
-	buffer[2] = 0
-	buffer[3] = 0
-	buf.Write(MSG_HEADER_LENGTH)
+	buf.Reserve(MSG_HEADER_LENGTH_V2)
+	n.writeHeader(buf, n.getWireVersion(), 'T', 0, 0)
+}
+
+func (n *tcpTransport) getWireVersion() int32 {
+	return atomic.LoadInt32(&n.wireVersion)
+}
+
+// checkWireVersion validates the first byte of an incoming packet. The first packet
+// in the link's own version, or the first one an incoming compat link reads, fixes
+// the version; other versions are only accepted in compatibility mode.
+func (n *tcpTransport) checkWireVersion(b byte) (int32, error) {
+	peer := int32(MSG_VERSION_1)
+	if b == MSG_MAGIC_V2 {
+		peer = MSG_VERSION_2
+	}
+
+	version := n.getWireVersion()
+	if n.versionChecked == true {
+		if peer != version {
+			return 0, errors.New("msg packet wire version changed.")
+		}
+		return version, nil
+	}
+
+	if peer == version {
+		n.versionChecked = true
+		return peer, nil
+	}
+
+	if n.option.wire_compat == false {
+		return 0, errors.New("msg packet wire version not supported.")
+	}
+
+	// a compat server writes v1 until it has read the first v2 packet of this link
+	if n.connType == Linker_TCP_OutGoing && peer == MSG_VERSION_1 {
+		return peer, nil
+	}
+
+	n.versionChecked = true
+	atomic.StoreInt32(&n.wireVersion, peer)
+	return peer, nil
 }
 
 func (n *tcpTransport) Recv() bool {
-	tcpConn := n.conn
+	reader := n.reader
 	serve := n.serveHandler
 	msgPacket := &n.msgPacket
 
 	for {
-		msgID, msg, err := n.ReadMsgPacket(tcpConn)
+		msgID, msg, err := n.ReadMsgPacket(reader)
 		if err != nil {
+			if r := recvCloseReason(err); r.Code == CLOSE_OVERSIZE || r.Code == CLOSE_PROTOCOL_ERROR {
+				n.closeWithReason(r)
+			} else {
+				n.setCloseReason(r)
+			}
 			goto waitClose
 		}
 
 		nowTick := UnixTS()
 
+		switch msgPacket.MsgType {
+		case 'P', 'R':
+			if n.checkRecvRate(nowTick) == false {
+				if n.option.rate_limit_action == RATE_LIMIT_CLOSE {
+					goto waitClose
+				}
+				n.releaseReadMsg()
+				continue
+			}
+		}
+
 		switch msgPacket.MsgType {
 		case 'P':
-			serve.ServeHandler(n, msgID, msg)
+			if err := n.serveMsg(msgID, msg); err != nil {
+				n.closeWithReason(newCloseReason(CLOSE_PROTOCOL_ERROR, err))
+				goto waitClose
+			}
 		case 'R':
-			serve.ServeRpc(n, msgID, msg)
+			if h, ok := serve.(RpcRequestHandler); ok == true && msgPacket.RpcSeqID != 0 {
+				h.ServeRpcRequest(n, msgID, msgPacket.RpcSeqID, msg)
+			} else {
+				serve.ServeRpc(n, msgID, msg)
+			}
+		case 'A':
+			n.onRpcReply(msgID, msgPacket.RpcSeqID, msg)
 		case 'T':
 			n.Pong(nowTick)
+		case 'C':
+			n.onCloseMsg(msg)
+			goto waitClose
 		default:
+			n.closeWithReason(newCloseReason(CLOSE_PROTOCOL_ERROR, errors.New("msg packet type unknown.")))
 			goto waitClose
 		}
+		n.releaseReadMsg()
 	}
 
 waitClose:
+	n.failRpcCalls()
+	n.releaseReadMsg()
 	buf := n.recvBuf
 	n.recvBuf = nil
 	bufferPool.Put(buf)
 	return false
 }
 
-func (n *tcpTransport) ReadMsgPacket(conn net.Conn) (ProtoTypeID, []byte, error) {
-	buf := n.writeBuf
-	buf.Reserve(MSG_HEADER_LENGTH)
-
-	mBytes := buf.WriteBuf()
-	var rl int = 0
-	rl, err := io.ReadFull(conn, mBytes)
+func (n *tcpTransport) releaseReadMsg() {
+	if n.readMsg != nil {
+		n.readMsg.Release()
+		n.readMsg = nil
+	}
+}
 
-	if err != nil {
-		return 0, nil, err
+func (n *tcpTransport) supportedFlags() uint8 {
+	var flags uint8 = PACKET_FLAG_COMPRESS
+	if n.crypto != nil {
+		flags |= PACKET_FLAG_ENCRYPT
 	}
+	if n.option.msg_max_total > 0 {
+		flags |= PACKET_FLAG_FRAGMENT | PACKET_FLAG_FRAGMENT_END
+	}
+	return flags
+}
 
-	buf.write(rl)
+// ReadMsgPacket returns the next whole message, reassembling fragmented ones.
+func (n *tcpTransport) ReadMsgPacket(reader io.Reader) (ProtoTypeID, []byte, error) {
+	if n.packetCodec != nil {
+		return n.readCodecPacket(reader)
+	}
 
 	msgPacket := &n.msgPacket
+	for {
+		mBytes, err := n.readPacket(reader)
+		if err != nil {
+			return 0, nil, err
+		}
 
-	msgPacket.MsgType = mBytes[0]
-	msgPacket.BodyLength = bigEndian.Uint16(mBytes[1:])
-	msgPacket.PacketFlag = mBytes[3]
+		switch {
+		case msgPacket.MsgType == 'T' || msgPacket.MsgType == 'K' || msgPacket.MsgType == 'C':
+			return 0, mBytes, nil
+		case msgPacket.PacketFlag&PACKET_FLAG_FRAGMENT != 0:
+			mBytes, err = n.reassemble(mBytes)
+			if err != nil {
+				return 0, nil, err
+			}
+			if mBytes == nil {
+				continue
+			}
+		case n.fragment.msgType != 0:
+			return 0, nil, MSG_FRAGMENT_ERR
+		}
+		return n.parseMsgBody(mBytes)
+	}
+}
+
+func (n *tcpTransport) readPacket(reader io.Reader) ([]byte, error) {
+	buf := n.recvBuf
+	buf.Reset()
+	buf.Reserve(MSG_HEADER_LENGTH_V2)
+
+	header := buf.WriteBuf()
+	if _, err := io.ReadFull(reader, header[:1]); err != nil {
+		return nil, err
+	}
+
+	version, err := n.checkWireVersion(header[0])
+	if err != nil {
+		return nil, err
+	}
+
+	msgPacket := &n.msgPacket
+	if version == MSG_VERSION_1 {
+		if _, err := io.ReadFull(reader, header[1:MSG_HEADER_LENGTH]); err != nil {
+			return nil, err
+		}
+		msgPacket.MsgType = header[0]
+		msgPacket.BodyLength = uint32(bigEndian.Uint16(header[1:]))
+		msgPacket.PacketFlag = header[3]
+	} else {
+		if _, err := io.ReadFull(reader, header[1:MSG_HEADER_LENGTH_V2]); err != nil {
+			return nil, err
+		}
+		msgPacket.MsgType = header[1]
+		msgPacket.PacketFlag = header[2]
+		msgPacket.BodyLength = bigEndian.Uint32(header[3:])
+	}
+	msgPacket.RpcSeqID = 0
 
 	if msgPacket.MsgType == 'T' {
-		return 0, nil, nil
+		return nil, nil
 	}
 
-	if uint32(msgPacket.BodyLength) >= n.option.msg_max_length {
-		return 0, nil, errors.New("msg packet length too long.")
+	if msgPacket.MsgType == 'C' {
+		bodyLength := int(msgPacket.BodyLength)
+		if bodyLength < MSG_CLOSE_CODE_LENGTH || bodyLength > MSG_CLOSE_CODE_LENGTH+MSG_CLOSE_REASON_MAX {
+			return nil, errors.New("msg packet close frame error.")
+		}
+		buf.Reset()
+		buf.Reserve(bodyLength)
+		b := buf.WriteBuf()[:bodyLength]
+		if _, err := io.ReadFull(reader, b); err != nil {
+			return nil, err
+		}
+		return b, nil
 	}
 
-	buf.Reserve(int(msgPacket.BodyLength))
+	if msgPacket.MsgType == 'K' {
+		if msgPacket.BodyLength != MSG_KEY_LENGTH || msgPacket.PacketFlag != 0 {
+			return nil, MSG_HANDSHAKE_ERR
+		}
+		buf.Reset()
+		buf.Reserve(MSG_KEY_LENGTH)
+		key := buf.WriteBuf()[:MSG_KEY_LENGTH]
+		if _, err := io.ReadFull(reader, key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
 
-	mBytes = buf.WriteBuf()
+	if n.crypto != nil && msgPacket.PacketFlag&PACKET_FLAG_ENCRYPT == 0 {
+		return nil, errors.New("msg packet not encrypted.")
+	}
 
-	rl, err = io.ReadFull(conn, mBytes)
-	if err != nil {
-		return 0, nil, err
+	if msgPacket.PacketFlag&^n.supportedFlags() != 0 {
+		return nil, errors.New("msg packet flag not supported.")
 	}
 
-	buf.write(rl)
+	if msgPacket.BodyLength >= n.option.msg_max_length {
+		return nil, MSG_TOO_LONG_ERR
+	}
 
-	if rl < MSG_ID_LENGTH {
+	if msgPacket.BodyLength < MSG_ID_LENGTH && msgPacket.PacketFlag&PACKET_FLAG_FRAGMENT == 0 {
+		return nil, errors.New("msg packet length error")
+	}
+
+	bodyLength := int(msgPacket.BodyLength)
+	pkt := getBuffer(bodyLength)
+	mBytes := pkt.WriteBuf()[:bodyLength]
+	if _, err := io.ReadFull(reader, mBytes); err != nil {
+		putBuffer(pkt)
+		return nil, err
+	}
+	pkt.write(bodyLength)
+	n.packetBuf = pkt
+
+	if msgPacket.PacketFlag&PACKET_FLAG_ENCRYPT != 0 {
+		return n.crypto.open(mBytes, []byte{msgPacket.MsgType, msgPacket.PacketFlag})
+	}
+	return mBytes, nil
+}
+
+// parseMsgBody splits msg_id and seq_id off a whole msg body held by packetBuf and
+// hands the buffer over to readMsg.
+func (n *tcpTransport) parseMsgBody(mBytes []byte) (ProtoTypeID, []byte, error) {
+	msgPacket := &n.msgPacket
+	if msgPacket.PacketFlag&PACKET_FLAG_COMPRESS != 0 {
+		b, err := n.compressor.decompress(mBytes, n.maxMsgLength())
+		if err != nil {
+			return 0, nil, err
+		}
+		out := getBuffer(len(b))
+		mBytes = out.WriteBuf()[:len(b)]
+		out.WriteBytes(b)
+		putBuffer(n.packetBuf)
+		n.packetBuf = out
+	}
+
+	if len(mBytes) < MSG_ID_LENGTH {
 		return 0, nil, errors.New("msg packet length error")
 	}
 
 	var msgID ProtoTypeID = 0
 	msgID = bigEndian.Uint32(mBytes)
 	msgBody := mBytes[MSG_ID_LENGTH:]
+
+	if isRpcMsgType(msgPacket.MsgType) == true {
+		if len(msgBody) < MSG_SEQ_LENGTH {
+			return 0, nil, errors.New("rpc msg packet length error")
+		}
+		msgPacket.RpcSeqID = bigEndian.Uint32(msgBody)
+		msgBody = msgBody[MSG_SEQ_LENGTH:]
+	}
+
+	n.readMsg = newMsgBuffer(n.packetBuf, msgBody)
+	n.packetBuf = nil
 	return msgID, msgBody, nil
 }
@@ -0,0 +1,110 @@
+package network
+
+import (
+	"github.com/Cyinx/einx/event"
+	"github.com/Cyinx/einx/slog"
+	"math/rand"
+	"net"
+)
+
+type UdpClientMgr struct {
+	name          string
+	component_id  ComponentID
+	module        EventReceiver
+	agent_handler SessionHandler
+	option        TransportOption
+}
+
+func NewUdpClientMgr(opts ...Option) Component {
+	udp_client := &UdpClientMgr{
+		component_id: GenComponentID(),
+		option:       newTransportOption(),
+	}
+
+	for _, opt := range opts {
+		opt(udp_client)
+	}
+
+	if udp_client.agent_handler == nil {
+		panic("option agent handler is nil")
+	}
+
+	if udp_client.module == nil {
+		panic("option agent handler is nil")
+	}
+
+	return udp_client
+}
+
+func (this *UdpClientMgr) GetID() ComponentID {
+	return this.component_id
+}
+
+func (this *UdpClientMgr) GetType() ComponentType {
+	return COMPONENT_TYPE_UDP_CLIENT
+}
+
+func (this *UdpClientMgr) Start() bool {
+	return true
+}
+
+func (this *UdpClientMgr) Close() {
+
+}
+
+func (this *UdpClientMgr) Connect(addr string, user_type interface{}) {
+	go this.connect(addr, user_type)
+}
+
+func (this *UdpClientMgr) connect(addr string, user_type interface{}) {
+	raw_conn, err := net.Dial("udp", addr)
+	if err != nil {
+		slog.LogWarning("udp_client", "udp connect failed %v", err)
+		e := &event.ComponentEventMsg{}
+		e.MsgType = event.EVENT_COMPONENT_ERROR
+		e.Sender = this
+		e.Attach = user_type
+		e.Err = err
+		this.module.PushEventMsg(e)
+		return
+	}
+
+	s := newUdpSession(rand.Uint32(), raw_conn.LocalAddr(), raw_conn.RemoteAddr(), func(b []byte) error {
+		_, err := raw_conn.Write(b)
+		return err
+	})
+	s.onEnd = func(*udpSession) { _ = raw_conn.Close() }
+
+	go func() {
+		buf := make([]byte, UDP_MTU*2)
+		for {
+			n, err := raw_conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				_ = s.Close()
+				return
+			}
+			s.input(buf[:n])
+		}
+	}()
+
+	m := this.module
+	h := this.agent_handler
+
+	udp_agent := newTcpConn(s, h, Linker_TCP_OutGoing, m, this.component_id, &this.option)
+	udp_agent.SetUserType(user_type)
+	m.PostEvent(event.EVENT_TCP_CONNECTED, udp_agent, this.component_id)
+
+	go func() {
+		pingMgr.AddPing(udp_agent)
+		err := udp_agent.Run()
+		pingMgr.RemovePing(udp_agent)
+		m.PostEvent(event.EVENT_TCP_CLOSED, udp_agent, this.component_id, err)
+	}()
+}
+
+func (this *UdpClientMgr) GetOption() *TransportOption {
+	return &this.option
+}
@@ -0,0 +1,160 @@
+package network
+
+import (
+	"github.com/Cyinx/einx/event"
+	"github.com/Cyinx/einx/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+type UdpServerMgr struct {
+	name         string
+	conn         net.PacketConn
+	componentID  ComponentID
+	module       EventReceiver
+	agentHandler SessionHandler
+	addr         string
+	closeFlag    int32
+	option       TransportOption
+	lock         sync.Mutex
+	sessions     map[string]*udpSession
+}
+
+func NewUdpServerMgr(opts ...Option) Component {
+	udpServer := &UdpServerMgr{
+		componentID: GenComponentID(),
+		closeFlag:   0,
+		option:      newTransportOption(),
+		sessions:    make(map[string]*udpSession),
+	}
+
+	for _, opt := range opts {
+		opt(udpServer)
+	}
+
+	if udpServer.agentHandler == nil {
+		panic("option agent handler is nil")
+	}
+
+	if udpServer.module == nil {
+		panic("option agent handler is nil")
+	}
+
+	return udpServer
+}
+
+func (this *UdpServerMgr) GetID() ComponentID {
+	return this.componentID
+}
+
+func (this *UdpServerMgr) GetType() ComponentType {
+	return COMPONENT_TYPE_UDP_SERVER
+}
+
+func (this *UdpServerMgr) Address() net.Addr {
+	if this.conn == nil {
+		return nil
+	}
+	return this.conn.LocalAddr()
+}
+
+func (this *UdpServerMgr) Start() bool {
+	conn, err := net.ListenPacket("udp", this.addr)
+	if err != nil {
+		slog.LogError("udp_server", "ListenUDP addr:[%s],Error:%s", this.addr, err.Error())
+		return false
+	}
+	this.conn = conn
+	go this.doUdpRecv()
+	return true
+}
+
+func (this *UdpServerMgr) Close() {
+	if atomic.CompareAndSwapInt32(&this.closeFlag, 0, 1) == true {
+		if this.conn == nil {
+			return
+		}
+		_ = this.conn.Close()
+	}
+}
+
+func (this *UdpServerMgr) isRunning() bool {
+	close_flag := atomic.LoadInt32(&this.closeFlag)
+	return close_flag == 0
+}
+
+func (this *UdpServerMgr) doUdpRecv() {
+	conn := this.conn
+	buf := make([]byte, UDP_MTU*2)
+
+	for this.isRunning() {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			if this.isRunning() {
+				slog.LogError("udp_server", "ReadFrom Error: %v", err)
+			}
+			return
+		}
+
+		conv, cmd, sn, _, _, ok := parseUdpSegment(buf[:n])
+		if ok == false {
+			continue
+		}
+
+		key := addr.String()
+		this.lock.Lock()
+		s := this.sessions[key]
+		if s == nil || s.conv != conv {
+			if cmd != UDP_CMD_PUSH || sn != 0 {
+				this.lock.Unlock()
+				continue
+			}
+			if s != nil {
+				go s.Close()
+			}
+			s = this.newSession(conv, addr)
+			this.sessions[key] = s
+		}
+		this.lock.Unlock()
+
+		s.input(buf[:n])
+	}
+}
+
+func (this *UdpServerMgr) newSession(conv uint32, addr net.Addr) *udpSession {
+	conn := this.conn
+	s := newUdpSession(conv, conn.LocalAddr(), addr, func(b []byte) error {
+		_, err := conn.WriteTo(b, addr)
+		return err
+	})
+	s.onEnd = this.removeSession
+
+	m := this.module
+	udpAgent := newTcpConn(s, this.agentHandler, Linker_TCP_InComming, m, this.componentID, &this.option)
+	m.PostEvent(event.EVENT_TCP_ACCEPTED, udpAgent, this.componentID)
+
+	go func() {
+		pingMgr.AddPing(udpAgent)
+		err := udpAgent.Run()
+		pingMgr.RemovePing(udpAgent)
+		m.PostEvent(event.EVENT_TCP_CLOSED, udpAgent, this.componentID, err)
+	}()
+	return s
+}
+
+func (this *UdpServerMgr) removeSession(s *udpSession) {
+	key := s.RemoteAddr().String()
+	this.lock.Lock()
+	if this.sessions[key] == s {
+		delete(this.sessions, key)
+	}
+	this.lock.Unlock()
+}
+
+func (this *UdpServerMgr) GetOption() *TransportOption {
+	return &this.option
+}
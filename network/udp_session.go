@@ -0,0 +1,421 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------
+// |                        udp segment                                |
+// | conv uint32 | cmd uint8 | sn uint32 | una uint32 | len uint16 | data |
+// ---------------------------------------------------------------------
+const (
+	UDP_CMD_PUSH = 1
+	UDP_CMD_ACK  = 2
+	UDP_CMD_FIN  = 3
+)
+
+const (
+	UDP_SEGMENT_HEADER = 15
+	UDP_MTU            = 1400
+	UDP_MSS            = UDP_MTU - UDP_SEGMENT_HEADER
+	UDP_WND_SIZE       = 256
+	UDP_SND_QUEUE_SIZE = UDP_WND_SIZE * 2
+	UDP_INTERVAL       = 10   //Millisecond
+	UDP_RTO_MIN        = 30   //Millisecond
+	UDP_RTO_DEF        = 200  //Millisecond
+	UDP_RTO_MAX        = 5000 //Millisecond
+	UDP_DEAD_LINK      = 20
+)
+
+var (
+	UDP_SESSION_CLOSED_ERR = errors.New("udp session closed.")
+	UDP_DEAD_LINK_ERR      = errors.New("udp session dead link.")
+)
+
+type udpSegment struct {
+	sn       uint32
+	data     []byte
+	ts       int64
+	resendTs int64
+	rto      int64
+	xmit     int
+}
+
+// udpSession is a reliable, ordered byte stream over udp (a small KCP style ARQ:
+// selective ack, cumulative una, rto retransmit). It implements net.Conn so
+// TcpConn runs its packet framing over it unchanged.
+type udpSession struct {
+	conv   uint32
+	local  net.Addr
+	remote net.Addr
+	output func([]byte) error
+	onEnd  func(*udpSession)
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	sndNxt   uint32
+	sndUna   uint32
+	sndQueue [][]byte
+	sndBuf   []*udpSegment
+	rcvNxt   uint32
+	rcvBuf   map[uint32][]byte
+	readBuf  []byte
+	ackList  []uint32
+	srtt     int64
+	rttvar   int64
+	rto      int64
+	closed   bool
+	closeErr error
+	dieChan  chan struct{}
+	sendBuf  []byte
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+func newUdpSession(conv uint32, local net.Addr, remote net.Addr, output func([]byte) error) *udpSession {
+	s := &udpSession{
+		conv:    conv,
+		local:   local,
+		remote:  remote,
+		output:  output,
+		rcvBuf:  make(map[uint32][]byte),
+		rto:     UDP_RTO_DEF,
+		dieChan: make(chan struct{}),
+		sendBuf: make([]byte, UDP_MTU),
+	}
+	s.cond = sync.NewCond(&s.lock)
+	go s.run()
+	return s
+}
+
+func seqDiff(a uint32, b uint32) int32 {
+	return int32(a - b)
+}
+
+func parseUdpSegment(b []byte) (conv uint32, cmd byte, sn uint32, una uint32, data []byte, ok bool) {
+	if len(b) < UDP_SEGMENT_HEADER {
+		return
+	}
+	conv = bigEndian.Uint32(b)
+	cmd = b[4]
+	sn = bigEndian.Uint32(b[5:])
+	una = bigEndian.Uint32(b[9:])
+	length := int(bigEndian.Uint16(b[13:]))
+	if len(b) < UDP_SEGMENT_HEADER+length {
+		return
+	}
+	data = b[UDP_SEGMENT_HEADER : UDP_SEGMENT_HEADER+length]
+	ok = true
+	return
+}
+
+func (s *udpSession) sendSegment(cmd byte, sn uint32, data []byte) {
+	b := s.sendBuf[:UDP_SEGMENT_HEADER+len(data)]
+	bigEndian.PutUint32(b, s.conv)
+	b[4] = cmd
+	bigEndian.PutUint32(b[5:], sn)
+	bigEndian.PutUint32(b[9:], s.rcvNxt)
+	bigEndian.PutUint16(b[13:], uint16(len(data)))
+	copy(b[UDP_SEGMENT_HEADER:], data)
+	_ = s.output(b)
+}
+
+func (s *udpSession) run() {
+	ticker := time.NewTicker(UDP_INTERVAL * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.lock.Lock()
+			s.flush()
+			s.lock.Unlock()
+		case <-s.dieChan:
+			return
+		}
+	}
+}
+
+func (s *udpSession) flush() {
+	if s.closed == true {
+		return
+	}
+
+	for _, sn := range s.ackList {
+		s.sendSegment(UDP_CMD_ACK, sn, nil)
+	}
+	s.ackList = s.ackList[:0]
+
+	now := UnixTS()
+	if len(s.sndQueue) > 0 && seqDiff(s.sndNxt, s.sndUna) < UDP_WND_SIZE {
+		// writers blocked on a full sndQueue
+		s.cond.Broadcast()
+	}
+	for len(s.sndQueue) > 0 && seqDiff(s.sndNxt, s.sndUna) < UDP_WND_SIZE {
+		seg := &udpSegment{
+			sn:   s.sndNxt,
+			data: s.sndQueue[0],
+			rto:  s.rto,
+		}
+		s.sndQueue[0] = nil
+		s.sndQueue = s.sndQueue[1:]
+		s.sndNxt++
+		s.sndBuf = append(s.sndBuf, seg)
+	}
+
+	for _, seg := range s.sndBuf {
+		if seg.xmit > 0 && now < seg.resendTs {
+			continue
+		}
+		if seg.xmit > 0 {
+			seg.rto += seg.rto / 2
+			if seg.rto > UDP_RTO_MAX {
+				seg.rto = UDP_RTO_MAX
+			}
+		}
+		seg.xmit++
+		if seg.xmit > UDP_DEAD_LINK {
+			s.doClose(UDP_DEAD_LINK_ERR, false)
+			return
+		}
+		seg.ts = now
+		seg.resendTs = now + seg.rto
+		s.sendSegment(UDP_CMD_PUSH, seg.sn, seg.data)
+	}
+}
+
+func (s *udpSession) updateRtt(rtt int64) {
+	if s.srtt == 0 {
+		s.srtt = rtt
+		s.rttvar = rtt / 2
+	} else {
+		delta := rtt - s.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		s.rttvar = (3*s.rttvar + delta) / 4
+		s.srtt = (7*s.srtt + rtt) / 8
+	}
+	rto := s.srtt + 4*s.rttvar + UDP_INTERVAL
+	if rto < UDP_RTO_MIN {
+		rto = UDP_RTO_MIN
+	} else if rto > UDP_RTO_MAX {
+		rto = UDP_RTO_MAX
+	}
+	s.rto = rto
+}
+
+func (s *udpSession) ackUna(una uint32) {
+	i := 0
+	for ; i < len(s.sndBuf); i++ {
+		if seqDiff(s.sndBuf[i].sn, una) >= 0 {
+			break
+		}
+	}
+	if i > 0 {
+		s.sndBuf = append(s.sndBuf[:0], s.sndBuf[i:]...)
+	}
+	if seqDiff(una, s.sndUna) > 0 {
+		s.sndUna = una
+	}
+}
+
+func (s *udpSession) ackSn(sn uint32) {
+	for i, seg := range s.sndBuf {
+		if seg.sn == sn {
+			if seg.xmit == 1 {
+				s.updateRtt(UnixTS() - seg.ts)
+			}
+			s.sndBuf = append(s.sndBuf[:i], s.sndBuf[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *udpSession) input(b []byte) {
+	_, cmd, sn, una, data, ok := parseUdpSegment(b)
+	if ok == false {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed == true {
+		return
+	}
+
+	s.ackUna(una)
+
+	switch cmd {
+	case UDP_CMD_ACK:
+		s.ackSn(sn)
+	case UDP_CMD_PUSH:
+		// segments beyond the window are dropped unacked, so the sender resends them
+		if seqDiff(sn, s.rcvNxt) >= UDP_WND_SIZE {
+			break
+		}
+		s.ackList = append(s.ackList, sn)
+		if seqDiff(sn, s.rcvNxt) < 0 {
+			break
+		}
+		if _, ok := s.rcvBuf[sn]; ok == false {
+			segData := make([]byte, len(data))
+			copy(segData, data)
+			s.rcvBuf[sn] = segData
+		}
+		for {
+			segData, ok := s.rcvBuf[s.rcvNxt]
+			if ok == false {
+				break
+			}
+			delete(s.rcvBuf, s.rcvNxt)
+			s.readBuf = append(s.readBuf, segData...)
+			s.rcvNxt++
+		}
+		s.cond.Broadcast()
+	case UDP_CMD_FIN:
+		s.doClose(io.EOF, false)
+	}
+}
+
+func (s *udpSession) Read(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.readBuf) == 0 {
+		if s.closed == true {
+			return 0, s.closeErr
+		}
+		if isDeadlineExceeded(s.readDeadline) == true {
+			return 0, os.ErrDeadlineExceeded
+		}
+		s.cond.Wait()
+	}
+	n := copy(b, s.readBuf)
+	s.readBuf = s.readBuf[n:]
+	if len(s.readBuf) == 0 {
+		s.readBuf = nil
+	}
+	return n, nil
+}
+
+// Write queues b in segments. It blocks while UDP_SND_QUEUE_SIZE segments wait
+// for the send window, so a slow peer holds the writer back, until the write
+// deadline passes or the session closes.
+func (s *udpSession) Write(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for {
+		if s.closed == true {
+			return n, UDP_SESSION_CLOSED_ERR
+		}
+		if isDeadlineExceeded(s.writeDeadline) == true {
+			return n, os.ErrDeadlineExceeded
+		}
+		for n < len(b) && len(s.sndQueue) < UDP_SND_QUEUE_SIZE {
+			end := n + UDP_MSS
+			if end > len(b) {
+				end = len(b)
+			}
+			seg := make([]byte, end-n)
+			copy(seg, b[n:end])
+			s.sndQueue = append(s.sndQueue, seg)
+			n = end
+		}
+		s.flush()
+		if n == len(b) {
+			return n, nil
+		}
+		s.cond.Wait()
+	}
+}
+
+func (s *udpSession) doClose(err error, sendFin bool) {
+	if s.closed == true {
+		return
+	}
+	if sendFin == true {
+		s.sendSegment(UDP_CMD_FIN, s.sndNxt, nil)
+	}
+	s.closed = true
+	s.closeErr = err
+	if s.readTimer != nil {
+		s.readTimer.Stop()
+		s.readTimer = nil
+	}
+	if s.writeTimer != nil {
+		s.writeTimer.Stop()
+		s.writeTimer = nil
+	}
+	close(s.dieChan)
+	s.cond.Broadcast()
+	if s.onEnd != nil {
+		go s.onEnd(s)
+	}
+}
+
+func (s *udpSession) Close() error {
+	s.lock.Lock()
+	s.doClose(UDP_SESSION_CLOSED_ERR, true)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *udpSession) LocalAddr() net.Addr {
+	return s.local
+}
+
+func (s *udpSession) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func isDeadlineExceeded(t time.Time) bool {
+	return t.IsZero() == false && time.Now().Before(t) == false
+}
+
+func (s *udpSession) SetDeadline(t time.Time) error {
+	_ = s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline wakes a blocked Read with a timer once t has passed.
+func (s *udpSession) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.readDeadline = t
+	s.readTimer = s.resetDeadlineTimer(s.readTimer, t)
+	return nil
+}
+
+// SetWriteDeadline wakes a Write blocked on a full sndQueue once t has passed.
+func (s *udpSession) SetWriteDeadline(t time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.writeDeadline = t
+	s.writeTimer = s.resetDeadlineTimer(s.writeTimer, t)
+	return nil
+}
+
+// resetDeadlineTimer replaces timer by one broadcasting the cond at t, nil for no deadline.
+func (s *udpSession) resetDeadlineTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+		timer = nil
+	}
+	if t.IsZero() == false && s.closed == false {
+		timer = time.AfterFunc(time.Until(t), func() {
+			s.lock.Lock()
+			s.cond.Broadcast()
+			s.lock.Unlock()
+		})
+	}
+	s.cond.Broadcast()
+	return timer
+}
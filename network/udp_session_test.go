@@ -0,0 +1,175 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyLink delivers the output of one session to the input of another,
+// dropping a share of the segments.
+type lossyLink struct {
+	lock sync.Mutex
+	rnd  *rand.Rand
+	loss float64
+	peer *udpSession
+}
+
+func (l *lossyLink) output(b []byte) error {
+	l.lock.Lock()
+	drop := l.rnd.Float64() < l.loss
+	peer := l.peer
+	l.lock.Unlock()
+	if drop == true || peer == nil {
+		return nil
+	}
+	seg := make([]byte, len(b))
+	copy(seg, b)
+	go peer.input(seg)
+	return nil
+}
+
+func newSessionPair(loss float64) (*udpSession, *udpSession) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	ab := &lossyLink{rnd: rand.New(rand.NewSource(1)), loss: loss}
+	ba := &lossyLink{rnd: rand.New(rand.NewSource(2)), loss: loss}
+	a := newUdpSession(1, addr, addr, ab.output)
+	b := newUdpSession(1, addr, addr, ba.output)
+	ab.lock.Lock()
+	ab.peer = b
+	ab.lock.Unlock()
+	ba.lock.Lock()
+	ba.peer = a
+	ba.lock.Unlock()
+	return a, b
+}
+
+// transfer writes data from a in bursts and reads it back from b.
+func transfer(t *testing.T, a *udpSession, b *udpSession, data []byte, timeout time.Duration) {
+	go func() {
+		for i := 0; i < len(data); i += 3000 {
+			end := i + 3000
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, err := a.Write(data[i:end]); err != nil {
+				return
+			}
+		}
+	}()
+
+	_ = b.SetReadDeadline(time.Now().Add(timeout))
+	got := make([]byte, len(data))
+	if n, err := io.ReadFull(b, got); err != nil {
+		t.Fatalf("read %d of %d bytes: %v", n, len(data), err)
+	}
+	if bytes.Equal(got, data) == false {
+		t.Fatal("data corrupted or out of order")
+	}
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+func TestUdpSessionOrder(t *testing.T) {
+	a, b := newSessionPair(0)
+	defer a.Close()
+	defer b.Close()
+	transfer(t, a, b, randomBytes(200*1024), 5*time.Second)
+}
+
+func TestUdpSessionRetransmit(t *testing.T) {
+	a, b := newSessionPair(0.2)
+	defer a.Close()
+	defer b.Close()
+	transfer(t, a, b, randomBytes(64*1024), 20*time.Second)
+}
+
+func TestUdpSessionWindow(t *testing.T) {
+	a, b := newSessionPair(0.1)
+	defer a.Close()
+	defer b.Close()
+
+	// far more segments than UDP_WND_SIZE are queued at once
+	data := randomBytes(UDP_MSS * UDP_WND_SIZE * 2)
+	transfer(t, a, b, data, 30*time.Second)
+
+	a.lock.Lock()
+	inFlight := seqDiff(a.sndNxt, a.sndUna)
+	a.lock.Unlock()
+	if inFlight > UDP_WND_SIZE {
+		t.Fatalf("%d segments in flight, window is %d", inFlight, UDP_WND_SIZE)
+	}
+}
+
+func TestUdpSessionFin(t *testing.T) {
+	a, b := newSessionPair(0)
+	defer b.Close()
+
+	data := randomBytes(1000)
+	transfer(t, a, b, data, 5*time.Second)
+	a.Close()
+
+	_ = b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := b.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after peer close: %v, want io.EOF", err)
+	}
+	if _, err := a.Write(data); err != UDP_SESSION_CLOSED_ERR {
+		t.Fatalf("write after close: %v", err)
+	}
+}
+
+func TestUdpSessionReadDeadline(t *testing.T) {
+	a, b := newSessionPair(0)
+	defer a.Close()
+	defer b.Close()
+
+	start := time.Now()
+	_ = b.SetReadDeadline(start.Add(50 * time.Millisecond))
+	_, err := b.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok == false || ne.Timeout() == false {
+		t.Fatalf("read error %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("read deadline took %v", d)
+	}
+
+	_ = b.SetReadDeadline(time.Time{})
+	if _, err := a.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("read after clearing deadline: %v", err)
+	}
+}
+
+func TestUdpSessionWriteBackpressure(t *testing.T) {
+	a, b := newSessionPair(1)
+	defer a.Close()
+	defer b.Close()
+
+	// the peer never acks: Write blocks once the queue is full, until its deadline
+	data := randomBytes(UDP_MSS * UDP_SND_QUEUE_SIZE * 4)
+	_ = a.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := a.Write(data)
+	if ne, ok := err.(net.Error); ok == false || ne.Timeout() == false {
+		t.Fatalf("write error %v, want a timeout", err)
+	}
+	if n >= len(data) {
+		t.Fatalf("wrote %d of %d bytes to a dead peer", n, len(data))
+	}
+
+	a.lock.Lock()
+	queued := len(a.sndQueue)
+	a.lock.Unlock()
+	if queued > UDP_SND_QUEUE_SIZE {
+		t.Fatalf("%d segments queued, limit is %d", queued, UDP_SND_QUEUE_SIZE)
+	}
+}
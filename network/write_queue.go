@@ -0,0 +1,173 @@
+package network
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	WRITE_DROP_NEWEST = iota + 1
+	WRITE_DROP_OLDEST
+	WRITE_CLOSE_LINK
+)
+
+var (
+	WRITE_QUEUE_FULL_ERR = errors.New("tcp transport write queue full.")
+)
+
+// linkWriteQueue is the pending write queue of a linker. Unlike queue.CondQueue it
+// keeps the queued byte count and can give up its oldest msgs, so a slow peer can
+// be held to the write_max_count / write_max_bytes limits of its TransportOption.
+// Pings, close frames and the close marker (nil) are never counted, limited or
+// dropped. Rpc answers are counted but never limited or dropped, so a full queue
+// can not swallow the answer a peer waits for, and rpc requests are never dropped
+// once queued, so no pending call is left without its request.
+type linkWriteQueue struct {
+	lock  sync.Mutex
+	cond  *sync.Cond
+	msgs  []ITransportMsg
+	head  int
+	count int
+	bytes int
+}
+
+func newLinkWriteQueue() *linkWriteQueue {
+	q := &linkWriteQueue{}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+func transportMsgSize(m ITransportMsg) int {
+	switch v := m.(type) {
+	case *TransportMsgPack:
+		return len(v.Buf) + MSG_ID_LENGTH
+	case *TransportMultiple:
+		return v.count
+	case *groupFrame:
+		return len(v.body) + MSG_ID_LENGTH
+	}
+	return 0
+}
+
+func isCountedMsg(m ITransportMsg) bool {
+	return m != nil && m.GetType() != 'T' && m.GetType() != 'C'
+}
+
+func isLimitedMsg(m ITransportMsg) bool {
+	return isCountedMsg(m) == true && m.GetType() != 'A'
+}
+
+func isDroppableMsg(m ITransportMsg) bool {
+	return isLimitedMsg(m) == true && m.GetType() != 'R'
+}
+
+// Push queues m, applying policy when the limits (0 means unlimited) would be
+// exceeded. It returns false when m was not queued.
+func (q *linkWriteQueue) Push(m ITransportMsg, maxCount int, maxBytes int, policy int) bool {
+	size := 0
+	counted := isCountedMsg(m)
+	if counted == true {
+		size = transportMsgSize(m)
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if isLimitedMsg(m) == true {
+		for q.isOver(size, maxCount, maxBytes) == true {
+			if policy != WRITE_DROP_OLDEST || q.dropOldest() == false {
+				return false
+			}
+		}
+	}
+	if counted == true {
+		q.count++
+		q.bytes += size
+	}
+
+	q.msgs = append(q.msgs, m)
+	q.cond.Signal()
+	return true
+}
+
+func (q *linkWriteQueue) isOver(size int, maxCount int, maxBytes int) bool {
+	if maxCount > 0 && q.count+1 > maxCount {
+		return true
+	}
+	return maxBytes > 0 && q.bytes+size > maxBytes
+}
+
+func (q *linkWriteQueue) dropOldest() bool {
+	for i := q.head; i < len(q.msgs); i++ {
+		m := q.msgs[i]
+		if isDroppableMsg(m) == false {
+			continue
+		}
+		copy(q.msgs[i:], q.msgs[i+1:])
+		q.msgs[len(q.msgs)-1] = nil
+		q.msgs = q.msgs[:len(q.msgs)-1]
+		q.count--
+		q.bytes -= transportMsgSize(m)
+		m.reset()
+		return true
+	}
+	return false
+}
+
+// Get blocks until msgs are queued and moves up to count of them into list. They
+// stay accounted for until the writer has flushed them and calls Done.
+func (q *linkWriteQueue) Get(list []interface{}, count uint32) uint32 {
+	q.lock.Lock()
+	for q.head == len(q.msgs) {
+		q.cond.Wait()
+	}
+
+	var c uint32 = 0
+	for c < count && q.head < len(q.msgs) {
+		m := q.msgs[q.head]
+		q.msgs[q.head] = nil
+		q.head++
+		list[c] = m
+		c++
+	}
+
+	if q.head == len(q.msgs) {
+		q.msgs = q.msgs[:0]
+		q.head = 0
+	} else if q.head > len(q.msgs)/2 {
+		n := copy(q.msgs, q.msgs[q.head:])
+		q.msgs = q.msgs[:n]
+		q.head = 0
+	}
+	q.lock.Unlock()
+	return c
+}
+
+// Poll is Get without waiting, it returns 0 when nothing is queued.
+func (q *linkWriteQueue) Poll(list []interface{}, count uint32) uint32 {
+	q.lock.Lock()
+	if q.head == len(q.msgs) {
+		q.lock.Unlock()
+		return 0
+	}
+	q.lock.Unlock()
+	return q.Get(list, count)
+}
+
+// Done uncounts count msgs of size bytes once the writer has flushed them.
+func (q *linkWriteQueue) Done(count int, size int) {
+	if count == 0 {
+		return
+	}
+	q.lock.Lock()
+	q.count -= count
+	q.bytes -= size
+	q.lock.Unlock()
+}
+
+func (q *linkWriteQueue) Stat() (int, int) {
+	q.lock.Lock()
+	c, b := q.count, q.bytes
+	q.lock.Unlock()
+	return c, b
+}
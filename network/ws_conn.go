@@ -0,0 +1,269 @@
+package network
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WS_OP_CONTINUATION = 0x0
+	WS_OP_TEXT         = 0x1
+	WS_OP_BINARY       = 0x2
+	WS_OP_CLOSE        = 0x8
+	WS_OP_PING         = 0x9
+	WS_OP_PONG         = 0xa
+)
+
+// WS_CONTROL_MAX_LENGTH is the payload limit of close, ping and pong frames, which
+// must not be fragmented either (RFC 6455 5.5).
+const WS_CONTROL_MAX_LENGTH = 125
+
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	WS_HANDSHAKE_ERR  = errors.New("websocket handshake error.")
+	WS_FRAME_ERR      = errors.New("websocket frame error.")
+	WS_FRAME_SIZE_ERR = errors.New("websocket frame too large.")
+)
+
+// wsConn presents a websocket as a byte stream: every Write is sent as one binary
+// message and Read returns the payload of data messages in order, so TcpConn can
+// run its own packet framing on top of it unchanged.
+type wsConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+	maxFrame  int
+	payload   []byte
+	closed    bool
+}
+
+func isWsUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsAcceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func upgradeWsConn(w http.ResponseWriter, r *http.Request, maxFrame int) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || isWsUpgrade(r) == false || key == "" ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, WS_HANDSHAKE_ERR
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if ok == false {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, WS_HANDSHAKE_ERR
+	}
+
+	rawConn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n")
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		_ = rawConn.Close()
+		return nil, err
+	}
+
+	c := &wsConn{
+		conn:     rawConn,
+		reader:   rw.Reader,
+		maxFrame: maxFrame,
+	}
+	return c, nil
+}
+
+func (c *wsConn) readFrame() (byte, bool, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(c.reader, header[:2]); err != nil {
+		return 0, false, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	if header[0]&0x70 != 0 || masked == false {
+		return 0, false, nil, WS_FRAME_ERR
+	}
+
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(c.reader, header[:2]); err != nil {
+			return 0, false, nil, err
+		}
+		length = uint64(bigEndian.Uint16(header[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.reader, header[:8]); err != nil {
+			return 0, false, nil, err
+		}
+		length = bigEndian.Uint64(header[:8])
+	}
+
+	if opcode&0x8 != 0 && (fin == false || length > WS_CONTROL_MAX_LENGTH) {
+		return 0, false, nil, WS_FRAME_ERR
+	}
+
+	if length > uint64(c.maxFrame) {
+		return 0, false, nil, WS_FRAME_SIZE_ERR
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return 0, false, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return 0, false, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, fin, payload, nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	var header [10]byte
+	header[0] = 0x80 | opcode
+	n := 2
+	length := len(payload)
+	switch {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		bigEndian.PutUint16(header[2:], uint16(length))
+		n += 2
+	default:
+		header[1] = 127
+		bigEndian.PutUint64(header[2:], uint64(length))
+		n += 8
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if _, err := c.conn.Write(header[:n]); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+func (c *wsConn) nextMessage() error {
+	var message []byte = nil
+	inMessage := false
+	for {
+		opcode, fin, payload, err := c.readFrame()
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case WS_OP_PING:
+			if err := c.writeFrame(WS_OP_PONG, payload); err != nil {
+				return err
+			}
+			continue
+		case WS_OP_PONG:
+			continue
+		case WS_OP_CLOSE:
+			_ = c.writeFrame(WS_OP_CLOSE, nil)
+			return io.EOF
+		case WS_OP_TEXT, WS_OP_BINARY:
+			if inMessage == true {
+				return WS_FRAME_ERR
+			}
+			inMessage = true
+			message = payload
+		case WS_OP_CONTINUATION:
+			if inMessage == false {
+				return WS_FRAME_ERR
+			}
+			if len(message)+len(payload) > c.maxFrame {
+				return WS_FRAME_SIZE_ERR
+			}
+			message = append(message, payload...)
+		default:
+			return WS_FRAME_ERR
+		}
+
+		if fin == true {
+			c.payload = message
+			return nil
+		}
+	}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for len(c.payload) == 0 {
+		if err := c.nextMessage(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.payload)
+	c.payload = c.payload[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(WS_OP_BINARY, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) Close() error {
+	c.writeLock.Lock()
+	closed := c.closed
+	c.closed = true
+	c.writeLock.Unlock()
+	if closed == false {
+		_ = c.writeFrame(WS_OP_CLOSE, nil)
+	}
+	return c.conn.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
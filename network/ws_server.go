@@ -0,0 +1,128 @@
+package network
+
+import (
+	"crypto/tls"
+	"github.com/Cyinx/einx/event"
+	"github.com/Cyinx/einx/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+type WsServerMgr struct {
+	name         string
+	listener     net.Listener
+	server       *http.Server
+	componentID  ComponentID
+	module       EventReceiver
+	agentHandler SessionHandler
+	addr         string
+	path         string
+	checkOrigin  func(*http.Request) bool
+	closeFlag    int32
+	option       TransportOption
+	tlsConfig    *tls.Config
+}
+
+func NewWsServerMgr(opts ...Option) Component {
+	wsServer := &WsServerMgr{
+		componentID: GenComponentID(),
+		closeFlag:   0,
+		path:        "/",
+		option:      newTransportOption(),
+	}
+
+	for _, opt := range opts {
+		opt(wsServer)
+	}
+
+	if wsServer.agentHandler == nil {
+		panic("option agent handler is nil")
+	}
+
+	if wsServer.module == nil {
+		panic("option agent handler is nil")
+	}
+
+	return wsServer
+}
+
+func (this *WsServerMgr) GetID() ComponentID {
+	return this.componentID
+}
+
+func (this *WsServerMgr) GetType() ComponentType {
+	return COMPONENT_TYPE_WS_SERVER
+}
+
+func (this *WsServerMgr) Address() net.Addr {
+	if this.listener == nil {
+		return nil
+	}
+	return this.listener.Addr()
+}
+
+func (this *WsServerMgr) Start() bool {
+	listener, err := net.Listen("tcp", this.addr)
+	if err != nil {
+		slog.LogError("ws_server", "ListenWs addr:[%s],Error:%s", this.addr, err.Error())
+		return false
+	}
+	if this.tlsConfig != nil {
+		listener = tls.NewListener(listener, this.tlsConfig)
+	}
+	this.listener = listener
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(this.path, this.serveWs)
+	this.server = &http.Server{Handler: mux}
+
+	go func() {
+		err := this.server.Serve(listener)
+		if err != nil && this.isRunning() {
+			slog.LogError("ws_server", "Serve Error: %v", err)
+		}
+	}()
+	return true
+}
+
+func (this *WsServerMgr) Close() {
+	if atomic.CompareAndSwapInt32(&this.closeFlag, 0, 1) == true {
+		if this.server == nil {
+			return
+		}
+		_ = this.server.Close()
+	}
+}
+
+func (this *WsServerMgr) isRunning() bool {
+	close_flag := atomic.LoadInt32(&this.closeFlag)
+	return close_flag == 0
+}
+
+func (this *WsServerMgr) serveWs(w http.ResponseWriter, r *http.Request) {
+	if this.checkOrigin != nil && this.checkOrigin(r) == false {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	maxFrame := int(this.option.msg_max_length) + MSG_HEADER_LENGTH_V2 + MSG_ID_LENGTH + MSG_SEQ_LENGTH
+	rawConn, err := upgradeWsConn(w, r, maxFrame)
+	if err != nil {
+		slog.LogWarning("ws_server", "websocket upgrade [%v] error: %v", r.RemoteAddr, err)
+		return
+	}
+
+	m := this.module
+	wsAgent := newTcpConn(rawConn, this.agentHandler, Linker_TCP_InComming, m, this.componentID, &this.option)
+	m.PostEvent(event.EVENT_TCP_ACCEPTED, wsAgent, this.componentID)
+
+	pingMgr.AddPing(wsAgent)
+	err = wsAgent.Run()
+	pingMgr.RemovePing(wsAgent)
+	m.PostEvent(event.EVENT_TCP_CLOSED, wsAgent, this.componentID, err)
+}
+
+func (this *WsServerMgr) GetOption() *TransportOption {
+	return &this.option
+}
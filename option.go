@@ -1,10 +1,13 @@
 package einx
 
 import (
+	"crypto/tls"
 	"github.com/Cyinx/einx/event"
 	"github.com/Cyinx/einx/module"
 	"github.com/Cyinx/einx/network"
 	"github.com/Cyinx/einx/slog"
+	"net/http"
+	"time"
 )
 
 type Option = func(...interface{})
@@ -27,14 +30,40 @@ func OnClosing(f func()) Option {
 	}
 }
 
+func NodeName(name string) Option {
+	return func(args ...interface{}) {
+		module.SetNodeName(name)
+	}
+}
+
 type networkOpt struct {
-	Name               func(string) Option
-	Module             func(string) Option
-	ListenAddr         func(string) Option
-	ServeHandler       func(SessionHandler) Option
-	TransportMaxCount  func(int) Option
-	TransportMaxLength func(int) Option
-	TransportKeepAlive func(bool, int64) Option
+	Name                 func(string) Option
+	Module               func(string) Option
+	ListenAddr           func(string) Option
+	WsPath               func(string) Option
+	WsCheckOrigin        func(func(*http.Request) bool) Option
+	ServeHandler         func(SessionHandler) Option
+	TLSConfig            func(*tls.Config) Option
+	TcpReconnect         func(time.Duration, time.Duration, int) Option
+	TcpMaxConn           func(int, int) Option
+	TcpAcceptRate        func(int) Option
+	TcpIPFilter          func([]string, []string) Option
+	TcpProxyProtocol     func(bool) Option
+	TcpProxyTrusted      func([]string) Option
+	TransportMaxCount    func(int) Option
+	TransportMaxLength   func(int) Option
+	TransportKeepAlive   func(bool, int64) Option
+	TransportCodec       func(*CodecRegistry) Option
+	TransportWireVersion func(int, bool) Option
+	TransportCompress    func(int) Option
+	TransportEncrypt     func(bool) Option
+	TransportFragment    func(uint32) Option
+	TransportRateLimit   func(int) Option
+	TransportWriteLimit  func(int, int, int) Option
+	TransportFlush       func(int, time.Duration) Option
+	TransportLinger      func(time.Duration, bool) Option
+	TransportBatch       func(int) Option
+	TransportPacketCodec func(func() PacketCodec) Option
 }
 
 var NetworkOption networkOpt = networkOpt{
@@ -43,9 +72,29 @@ var NetworkOption networkOpt = networkOpt{
 		m := GetModule(s)
 		return network.Module(m.(event.EventReceiver))
 	},
-	ListenAddr:         network.ListenAddr,
-	ServeHandler:       network.ServeHandler,
-	TransportMaxCount:  network.TransportMaxCount,
-	TransportMaxLength: network.TransportMaxLength,
-	TransportKeepAlive: network.TransportKeepAlive,
+	ListenAddr:           network.ListenAddr,
+	WsPath:               network.WsPath,
+	WsCheckOrigin:        network.WsCheckOrigin,
+	ServeHandler:         network.ServeHandler,
+	TLSConfig:            network.TLSConfig,
+	TcpReconnect:         network.TcpReconnect,
+	TcpMaxConn:           network.TcpMaxConn,
+	TcpAcceptRate:        network.TcpAcceptRate,
+	TcpIPFilter:          network.TcpIPFilter,
+	TcpProxyProtocol:     network.TcpProxyProtocol,
+	TcpProxyTrusted:      network.TcpProxyTrusted,
+	TransportMaxCount:    network.TransportMaxCount,
+	TransportMaxLength:   network.TransportMaxLength,
+	TransportKeepAlive:   network.TransportKeepAlive,
+	TransportCodec:       network.TransportCodec,
+	TransportWireVersion: network.TransportWireVersion,
+	TransportCompress:    network.TransportCompress,
+	TransportEncrypt:     network.TransportEncrypt,
+	TransportFragment:    network.TransportFragment,
+	TransportRateLimit:   network.TransportRateLimit,
+	TransportWriteLimit:  network.TransportWriteLimit,
+	TransportFlush:       network.TransportFlush,
+	TransportLinger:      network.TransportLinger,
+	TransportBatch:       network.TransportBatch,
+	TransportPacketCodec: network.TransportPacketCodec,
 }